@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/proxy"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerAdminRoutes mounts the admin API when ADMIN_TOKEN is set. Every request must carry
+// the token as "Authorization: Bearer <token>".
+func registerAdminRoutes(e *echo.Echo) {
+	token := model.Configuration.AdminToken
+	if token == "" {
+		log.Debug("Admin API disabled; set ADMIN_TOKEN to enable it")
+		return
+	}
+
+	group := e.Group("/api/admin", requireAdminToken(token))
+	group.GET("", handleAdminOverview)
+	group.GET("/manifests", handleListManifests)
+	group.DELETE("/manifests", handlePurgeAllManifests)
+	group.DELETE("/manifests/:key", handlePurgeManifest)
+	group.GET("/prefetch", handleListPrefetchQueues)
+	group.POST("/sign", handleSignURL)
+}
+
+func requireAdminToken(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			provided, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				return echo.NewHTTPError(http.StatusUnauthorized, "admin token required")
+			}
+			return next(c)
+		}
+	}
+}
+
+func handleAdminOverview(c echo.Context) error {
+	return c.JSON(http.StatusOK, proxy.GetOverview())
+}
+
+func handleListManifests(c echo.Context) error {
+	return c.JSON(http.StatusOK, proxy.Manifests())
+}
+
+func handleListPrefetchQueues(c echo.Context) error {
+	return c.JSON(http.StatusOK, proxy.PrefetchQueues())
+}
+
+func handlePurgeManifest(c echo.Context) error {
+	// keys are base64 inputs, so "/" arrives escaped and echo leaves escaped params alone
+	key := c.Param("key")
+	if c.Request().URL.RawPath != "" {
+		unescaped, err := url.PathUnescape(key)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid manifest key")
+		}
+		key = unescaped
+	}
+	if !proxy.PurgeManifest(key) {
+		return echo.NewHTTPError(http.StatusNotFound, "manifest not found")
+	}
+	log.Infof("Admin purged manifest %s", key)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handlePurgeAllManifests(c echo.Context) error {
+	purged := proxy.PurgeAll()
+	log.Infof("Admin purged %d manifests", purged)
+	return c.JSON(http.StatusOK, map[string]int{"purged": purged})
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/bariiss/hls-proxy/metrics"
 	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
 )
@@ -71,6 +72,18 @@ func (r *countingReadCloser) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// requestRoute names the route for metrics: handlers behind the catch-all input route say
+// what they served, everything else uses the matched route pattern.
+func requestRoute(c echo.Context) string {
+	if route, ok := c.Get("route").(string); ok && route != "" {
+		return route
+	}
+	if path := c.Path(); path != "" {
+		return path
+	}
+	return "unmatched"
+}
+
 func jsonLoggerMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -134,6 +147,8 @@ func jsonLoggerMiddleware() echo.MiddlewareFunc {
 				errText = err.Error()
 			}
 
+			metrics.ObserveRequest(requestRoute(c), req.Method, status, latency, bytesUpstream)
+
 			log.WithFields(log.Fields{
 				"remote_ip":     c.RealIP(),
 				"host":          req.Host,
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/recording"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerRecordingRoutes mounts the recordings API when ADMIN_TOKEN is set. Jobs fetch any
+// origin and write to disk, so like the admin API every request must carry the token.
+func registerRecordingRoutes(e *echo.Echo) {
+	token := model.Configuration.AdminToken
+	if token == "" {
+		log.Debug("Recordings API disabled; set ADMIN_TOKEN to enable it")
+		return
+	}
+
+	group := e.Group("/api/recordings", requireAdminToken(token))
+	group.GET("", handleListRecordings)
+	group.POST("", handleCreateRecording)
+	group.GET("/:id", handleGetRecording)
+	group.POST("/:id/cancel", handleCancelRecording)
+	group.DELETE("/:id", handleDeleteRecording)
+}
+
+func handleListRecordings(c echo.Context) error {
+	jobs, err := recording.Jobs()
+	if err != nil {
+		return recordingError(err)
+	}
+	return c.JSON(http.StatusOK, jobs)
+}
+
+func handleCreateRecording(c echo.Context) error {
+	var req recording.JobRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid recording request")
+	}
+
+	job, err := recording.Schedule(req)
+	if err != nil {
+		return recordingError(err)
+	}
+	return c.JSON(http.StatusCreated, job)
+}
+
+func handleGetRecording(c echo.Context) error {
+	job, err := recording.GetJob(c.Param("id"))
+	if err != nil {
+		return recordingError(err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func handleCancelRecording(c echo.Context) error {
+	job, err := recording.CancelJob(c.Param("id"))
+	if err != nil {
+		return recordingError(err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func handleDeleteRecording(c echo.Context) error {
+	if err := recording.DeleteJob(c.Param("id")); err != nil {
+		return recordingError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func recordingError(err error) error {
+	switch {
+	case errors.Is(err, recording.ErrJobNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, recording.ErrInvalidJob):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, recording.ErrSchedulerDisabled):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	default:
+		return err
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -9,9 +10,15 @@ import (
 	"time"
 
 	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/metrics"
 	"github.com/bariiss/hls-proxy/model"
 	"github.com/bariiss/hls-proxy/parsing"
 	"github.com/bariiss/hls-proxy/proxy"
+	"github.com/bariiss/hls-proxy/recording"
+	"github.com/bariiss/hls-proxy/signing"
+	"github.com/bariiss/hls-proxy/streams"
+	"github.com/bariiss/hls-proxy/tracing"
+	"github.com/bariiss/hls-proxy/upstream"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -35,8 +42,39 @@ var (
 				return runHealthcheck()
 			}
 
+			if _, err := tracing.Configure(&model.Configuration); err != nil {
+				log.Errorf("tracing disabled: %v", err)
+			} else if model.Configuration.TracingEndpoint != "" {
+				log.Infof("Exporting traces to %s", model.Configuration.TracingEndpoint)
+			}
+			if err := upstream.Configure(&model.Configuration); err != nil {
+				return err
+			}
+			if model.Configuration.UpstreamTLSInsecure != "" {
+				log.Warnf("Not verifying TLS certificates of %s", model.Configuration.UpstreamTLSInsecure)
+			}
+			signing.Configure(model.Configuration.URLSigningSecret, model.Configuration.URLSigningTTL)
+			if err := configureInputTokens(model.Configuration.InputTokenKeys, model.Configuration.InputTokenGrace); err != nil {
+				return err
+			}
+			if model.Configuration.InputTokenRequireEncrypted {
+				if model.Configuration.InputTokenKeys == "" {
+					return errors.New("--input-token-require-encrypted needs INPUT_TOKEN_KEYS")
+				}
+				parsing.RequireEncryptedTokens(true)
+				log.Info("Refusing plain base64 input tokens")
+			}
+			if signing.Enabled() {
+				log.Infof("Proxy URLs must be signed; rewritten URLs are valid for %s", model.Configuration.URLSigningTTL)
+			}
 			proxy.InitPrefetcher(&model.Configuration)
-			log.Infof("Configuration: %+v", model.Configuration)
+			if err := recording.InitScheduler(&model.Configuration); err != nil {
+				log.Errorf("recording scheduler disabled: %v", err)
+			}
+			if err := streams.Init(&model.Configuration); err != nil {
+				log.Errorf("stream registry disabled: %v", err)
+			}
+			log.Infof("Configuration: %+v", model.Configuration.Redacted())
 
 			portInt, err := strconv.Atoi(flagValues.port)
 			if err != nil {
@@ -53,11 +91,28 @@ var (
 		segments                   int
 		segmentStore               bool
 		segmentCache               bool
+		segmentCacheMaxBytes       int64
 		segmentDir                 string
+		segmentStorePersist        bool
+		segmentStoreMaxBytes       int64
+		segmentStoreMinFreeBytes   int64
+		segmentStoreBackend        string
+		s3Endpoint                 string
+		s3Bucket                   string
+		s3Prefix                   string
+		s3Region                   string
+		s3PathStyle                bool
+		stateBackend               string
+		redisURL                   string
+		redisPrefix                string
+		redisSegmentMaxBytes       int64
 		segmentIdle                time.Duration
 		segmentIdleEnabled         bool
 		segmentIdleRequireSegments bool
 		segmentBackgroundFetch     bool
+		manifestPoll               bool
+		manifestCacheFraction      float64
+		manifestCacheStaticTTL     time.Duration
 		throttle                   int
 		janitor                    time.Duration
 		attempts                   int
@@ -69,6 +124,24 @@ var (
 		port                       string
 		logLevel                   string
 		healthcheck                bool
+		recordingDir               string
+		streamRegistryDir          string
+		metrics                    bool
+		tracingEndpoint            string
+		tracingSampleRatio         float64
+		tracingPropagate           bool
+		urlSigningTTL              time.Duration
+		inputTokenGrace            time.Duration
+		inputTokenRequireEncrypted bool
+		upstreamAllow              string
+		upstreamDeny               string
+		upstreamAllowPrivate       bool
+		upstreamTLSInsecure        string
+		upstreamCABundle           string
+		upstreamClientCerts        string
+		upstreamProxy              string
+		upstreamProxies            string
+		upstreamProxyRules         string
 	}
 )
 
@@ -77,11 +150,28 @@ func init() {
 	rootCmd.Flags().IntVar(&flagValues.segments, "segments", config.Settings.SegmentCount, "Number of segments to prefetch")
 	rootCmd.Flags().BoolVar(&flagValues.segmentStore, "segment-store", config.Settings.SegmentStore, "Persist fetched segments to disk for replay")
 	rootCmd.Flags().BoolVar(&flagValues.segmentCache, "segment-cache", config.Settings.SegmentCache, "Cache fetched segments in memory for replay")
+	rootCmd.Flags().Int64Var(&flagValues.segmentCacheMaxBytes, "segment-cache-max-bytes", config.Settings.SegmentCacheMaxBytes, "Global memory budget in bytes for cached segments across all manifests (0 for unbounded)")
 	rootCmd.Flags().StringVar(&flagValues.segmentDir, "segment-dir", config.Settings.SegmentStorageDir, "Directory for persisted segments when segment storage is enabled")
+	rootCmd.Flags().BoolVar(&flagValues.segmentStorePersist, "segment-store-persist", config.Settings.SegmentStorePersist, "Keep stored segments and their index across restarts so VOD streams replay without the origin")
+	rootCmd.Flags().Int64Var(&flagValues.segmentStoreMaxBytes, "segment-store-max-bytes", config.Settings.SegmentStoreMaxBytes, "Global disk quota in bytes for stored segments across all manifests (0 for unbounded)")
+	rootCmd.Flags().Int64Var(&flagValues.segmentStoreMinFreeBytes, "segment-store-min-free-bytes", config.Settings.SegmentStoreMinFreeBytes, "Stop writing segments when free space on the segment directory's filesystem drops below this many bytes (0 disables)")
+	rootCmd.Flags().StringVar(&flagValues.segmentStoreBackend, "segment-store-backend", config.Settings.SegmentStoreBackend, "Segment store backend: file (--segment-dir) or s3")
+	rootCmd.Flags().StringVar(&flagValues.s3Endpoint, "s3-endpoint", config.Settings.S3Endpoint, "S3-compatible endpoint URL for the s3 segment store backend")
+	rootCmd.Flags().StringVar(&flagValues.s3Bucket, "s3-bucket", config.Settings.S3Bucket, "Bucket holding stored segments for the s3 backend")
+	rootCmd.Flags().StringVar(&flagValues.s3Prefix, "s3-prefix", config.Settings.S3Prefix, "Key prefix for stored segments in the s3 bucket")
+	rootCmd.Flags().StringVar(&flagValues.s3Region, "s3-region", config.Settings.S3Region, "Region used to sign s3 requests")
+	rootCmd.Flags().BoolVar(&flagValues.s3PathStyle, "s3-path-style", config.Settings.S3PathStyle, "Address the bucket as endpoint/bucket instead of bucket.endpoint (MinIO and most self-hosted servers)")
+	rootCmd.Flags().StringVar(&flagValues.stateBackend, "state-backend", config.Settings.StateBackend, "Where manifest state and small segments live: memory (this process) or redis (shared by replicas)")
+	rootCmd.Flags().StringVar(&flagValues.redisURL, "redis-url", config.Settings.RedisURL, "Redis server URL for the redis state backend")
+	rootCmd.Flags().StringVar(&flagValues.redisPrefix, "redis-prefix", config.Settings.RedisPrefix, "Key prefix for shared state in redis")
+	rootCmd.Flags().Int64Var(&flagValues.redisSegmentMaxBytes, "redis-segment-max-bytes", config.Settings.RedisSegmentMaxBytes, "Largest segment in bytes shared through redis; larger ones stay in the local cache (0 for no limit)")
 	rootCmd.Flags().DurationVar(&flagValues.segmentIdle, "segment-idle-timeout", config.Settings.SegmentIdleTimeout, "Duration with no requests before manifest cache and stored segments are purged")
 	rootCmd.Flags().BoolVar(&flagValues.segmentIdleEnabled, "segment-idle-enabled", config.Settings.SegmentIdleEnabled, "Enable purging manifests and stored segments after periods of inactivity")
 	rootCmd.Flags().BoolVar(&flagValues.segmentIdleRequireSegments, "segment-idle-require-segments", config.Settings.SegmentIdleRequireSegments, "Require at least one segment request before idle cleanup can purge cached manifests")
 	rootCmd.Flags().BoolVar(&flagValues.segmentBackgroundFetch, "segment-background-fetch", config.Settings.SegmentBackgroundFetch, "Enable proactive background fetching of playlist segments for cache warming")
+	rootCmd.Flags().BoolVar(&flagValues.manifestPoll, "manifest-poll", config.Settings.ManifestPoll, "Refresh live media playlists in the background at the target duration cadence")
+	rootCmd.Flags().Float64Var(&flagValues.manifestCacheFraction, "manifest-cache-fraction", config.Settings.ManifestCacheFraction, "Fraction of the target duration a fetched live playlist is reused for all viewers (0 disables)")
+	rootCmd.Flags().DurationVar(&flagValues.manifestCacheStaticTTL, "manifest-cache-static-ttl", config.Settings.ManifestCacheStaticTTL, "Reuse window for fetched master and VOD playlists (0 disables)")
 	rootCmd.Flags().IntVar(&flagValues.throttle, "throttle", config.Settings.Throttle, "Requests per second limit for prefetching")
 	rootCmd.Flags().DurationVar(&flagValues.janitor, "janitor-interval", config.Settings.JanitorInterval, "Interval for cleaning cached playlists and clips")
 	rootCmd.Flags().IntVar(&flagValues.attempts, "attempts", config.Settings.Attempts, "Retry attempts for segment fetches")
@@ -93,6 +183,24 @@ func init() {
 	rootCmd.Flags().StringVar(&flagValues.port, "port", config.Settings.Port, "Port to bind the HTTP server")
 	rootCmd.Flags().StringVar(&flagValues.logLevel, "log-level", strings.ToUpper(config.Settings.LogLevel), "Log level (DEBUG, INFO, WARN, ERROR)")
 	rootCmd.Flags().BoolVar(&flagValues.healthcheck, "healthcheck", config.Settings.Healthcheck, "Run healthcheck against the configured server and exit")
+	rootCmd.Flags().StringVar(&flagValues.recordingDir, "recording-dir", config.Settings.RecordingDir, "Directory for scheduled recordings and the persisted job store")
+	rootCmd.Flags().StringVar(&flagValues.streamRegistryDir, "stream-registry-dir", config.Settings.StreamRegistryDir, "Directory holding registered short-ID streams and their child URLs")
+	rootCmd.Flags().BoolVar(&flagValues.metrics, "metrics", config.Settings.Metrics, "Expose Prometheus metrics on /metrics")
+	rootCmd.Flags().StringVar(&flagValues.tracingEndpoint, "tracing-endpoint", config.Settings.TracingEndpoint, "OTLP/HTTP collector URL to export traces to, e.g. http://localhost:4318 (empty disables tracing)")
+	rootCmd.Flags().Float64Var(&flagValues.tracingSampleRatio, "tracing-sample-ratio", config.Settings.TracingSampleRatio, "Fraction of traces to sample when the caller has not decided")
+	rootCmd.Flags().BoolVar(&flagValues.tracingPropagate, "tracing-propagate", config.Settings.TracingPropagate, "Send W3C trace context to origins so they can join the trace")
+	rootCmd.Flags().DurationVar(&flagValues.urlSigningTTL, "url-signing-ttl", config.Settings.URLSigningTTL, "How long signed URLs in rewritten playlists stay valid (signing needs URL_SIGNING_SECRET)")
+	rootCmd.Flags().DurationVar(&flagValues.inputTokenGrace, "input-token-grace", config.Settings.InputTokenGrace, "How long tokens encrypted with a rotated-out INPUT_TOKEN_KEYS entry keep working")
+	rootCmd.Flags().BoolVar(&flagValues.inputTokenRequireEncrypted, "input-token-require-encrypted", config.Settings.InputTokenRequireEncrypted, "Refuse plain base64 input tokens, accepting only encrypted ones (needs INPUT_TOKEN_KEYS)")
+	rootCmd.Flags().StringVar(&flagValues.upstreamAllow, "upstream-allow", config.Settings.UpstreamAllow, "Comma separated host globs, IPs or CIDRs origins must match (empty allows any public origin)")
+	rootCmd.Flags().StringVar(&flagValues.upstreamDeny, "upstream-deny", config.Settings.UpstreamDeny, "Comma separated host globs, IPs or CIDRs never fetched from")
+	rootCmd.Flags().BoolVar(&flagValues.upstreamAllowPrivate, "upstream-allow-private", config.Settings.UpstreamAllowPrivate, "Allow fetching from private, loopback and link-local addresses")
+	rootCmd.Flags().StringVar(&flagValues.upstreamTLSInsecure, "upstream-tls-insecure", config.Settings.UpstreamTLSInsecure, "Comma separated host globs whose TLS certificates are not verified (\"*\" for every origin)")
+	rootCmd.Flags().StringVar(&flagValues.upstreamCABundle, "upstream-ca-bundle", config.Settings.UpstreamCABundle, "Comma separated PEM files with CA certificates trusted for origins, on top of the system roots")
+	rootCmd.Flags().StringVar(&flagValues.upstreamClientCerts, "upstream-client-certs", config.Settings.UpstreamClientCerts, "Comma separated client certificates for mutual TLS, as host-glob=cert.pem:key.pem")
+	rootCmd.Flags().StringVar(&flagValues.upstreamProxy, "upstream-proxy", config.Settings.UpstreamProxy, "Proxy every origin is fetched through unless a rule says otherwise: an http, https or socks5 URL or a name from --upstream-proxies")
+	rootCmd.Flags().StringVar(&flagValues.upstreamProxies, "upstream-proxies", config.Settings.UpstreamProxies, "Comma separated named proxies streams may choose, as name=url")
+	rootCmd.Flags().StringVar(&flagValues.upstreamProxyRules, "upstream-proxy-rules", config.Settings.UpstreamProxyRules, "Comma separated host-glob=proxy rules, the proxy being a URL, a name from --upstream-proxies or \"direct\"")
 }
 
 func Execute() error {
@@ -100,21 +208,36 @@ func Execute() error {
 }
 
 func applyConfiguration() error {
-	if flagValues.segmentStore && flagValues.segmentCache {
-		log.Warn("segment cache disabled because segment store is enabled")
-		flagValues.segmentCache = false
-	}
-
 	options := model.ConfigInit{
 		Prefetch:                   flagValues.prefetch,
 		SegmentCount:               flagValues.segments,
 		SegmentStore:               flagValues.segmentStore,
 		SegmentCache:               flagValues.segmentCache,
+		SegmentCacheMaxBytes:       flagValues.segmentCacheMaxBytes,
 		SegmentStorageDir:          flagValues.segmentDir,
+		SegmentStorePersist:        flagValues.segmentStorePersist,
+		SegmentStoreMaxBytes:       flagValues.segmentStoreMaxBytes,
+		SegmentStoreMinFreeBytes:   flagValues.segmentStoreMinFreeBytes,
+		SegmentStoreBackend:        flagValues.segmentStoreBackend,
+		S3Endpoint:                 flagValues.s3Endpoint,
+		S3Bucket:                   flagValues.s3Bucket,
+		S3Prefix:                   flagValues.s3Prefix,
+		S3Region:                   flagValues.s3Region,
+		S3AccessKey:                config.Settings.S3AccessKey,
+		S3SecretKey:                config.Settings.S3SecretKey,
+		S3SessionToken:             config.Settings.S3SessionToken,
+		S3PathStyle:                flagValues.s3PathStyle,
+		StateBackend:               flagValues.stateBackend,
+		RedisURL:                   flagValues.redisURL,
+		RedisPrefix:                flagValues.redisPrefix,
+		RedisSegmentMaxBytes:       flagValues.redisSegmentMaxBytes,
 		SegmentIdleEnabled:         flagValues.segmentIdleEnabled,
 		SegmentIdleTimeout:         flagValues.segmentIdle,
 		SegmentIdleRequireSegments: flagValues.segmentIdleRequireSegments,
 		SegmentBackgroundFetch:     flagValues.segmentBackgroundFetch,
+		ManifestPoll:               flagValues.manifestPoll,
+		ManifestCacheFraction:      flagValues.manifestCacheFraction,
+		ManifestCacheStaticTTL:     flagValues.manifestCacheStaticTTL,
 		Throttle:                   flagValues.throttle,
 		Attempts:                   flagValues.attempts,
 		ClipRetention:              flagValues.clipRetention,
@@ -126,6 +249,27 @@ func applyConfiguration() error {
 		Port:                       flagValues.port,
 		LogLevel:                   flagValues.logLevel,
 		Healthcheck:                flagValues.healthcheck,
+		RecordingDir:               flagValues.recordingDir,
+		StreamRegistryDir:          flagValues.streamRegistryDir,
+		AdminToken:                 config.Settings.AdminToken,
+		Metrics:                    flagValues.metrics,
+		TracingEndpoint:            flagValues.tracingEndpoint,
+		TracingSampleRatio:         flagValues.tracingSampleRatio,
+		TracingPropagate:           flagValues.tracingPropagate,
+		URLSigningSecret:           config.Settings.URLSigningSecret,
+		URLSigningTTL:              flagValues.urlSigningTTL,
+		InputTokenKeys:             config.Settings.InputTokenKeys,
+		InputTokenGrace:            flagValues.inputTokenGrace,
+		InputTokenRequireEncrypted: flagValues.inputTokenRequireEncrypted,
+		UpstreamAllow:              flagValues.upstreamAllow,
+		UpstreamDeny:               flagValues.upstreamDeny,
+		UpstreamAllowPrivate:       flagValues.upstreamAllowPrivate,
+		UpstreamTLSInsecure:        flagValues.upstreamTLSInsecure,
+		UpstreamCABundle:           flagValues.upstreamCABundle,
+		UpstreamClientCerts:        flagValues.upstreamClientCerts,
+		UpstreamProxy:              flagValues.upstreamProxy,
+		UpstreamProxies:            flagValues.upstreamProxies,
+		UpstreamProxyRules:         flagValues.upstreamProxyRules,
 	}
 
 	model.InitializeConfig(options)
@@ -153,36 +297,82 @@ func launchServer(host string, port int) {
 	e := echo.New()
 
 	e.Use(middleware.CORS())
+	e.Use(tracingMiddleware())
 	e.Use(jsonLoggerMiddleware())
 	e.Use(middleware.Recover())
 
 	e.GET("/health", handleHealth)
-	e.GET("/:input", handleRequest)
+	registerRecordingRoutes(e)
+	registerAdminRoutes(e)
+	if model.Configuration.Metrics {
+		proxy.RegisterMetrics()
+		e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	}
+	registerStreamRoutes(e)
+	e.GET("/*", handleRequest)
 
 	address := fmt.Sprintf("%s:%d", host, port)
 	e.Logger.Fatal(e.Start(address))
 }
 
 func handleRequest(c echo.Context) error {
-	switch c.Param("input") {
+	// tokens in standard base64 may contain "/", so the whole path is the parameter
+	proxyPath := c.Param("*")
+	if c.Request().URL.RawPath != "" {
+		if unescaped, err := url.PathUnescape(proxyPath); err == nil {
+			proxyPath = unescaped
+		}
+	}
+	switch proxyPath {
 	case "favicon.ico", "apple-touch-icon.png", "apple-touch-icon-precomposed.png":
 		return echo.NewHTTPError(http.StatusNotFound, "resource not available")
 	}
 
-	input, err := parsing.ParseInputUrl(c.Param("input"))
+	input, token, err := parsing.ParseProxyPath(proxyPath)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	if signing.Enabled() {
+		err := signing.Verify(token, c.QueryParams())
+		if err != nil {
+			log.WithField("remote_ip", c.RealIP()).Warn("Rejected proxy request: ", err)
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+	}
+
+	return serveInput(c, input)
+}
+
+// serveInput proxies a playlist or, for anything else, a segment.
+func serveInput(c echo.Context, input *model.Input) error {
 	parsedURL, err := url.Parse(input.Url)
-	if err != nil {
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
 		return echo.NewHTTPError(http.StatusBadRequest, "malformed URL in request")
 	}
+	if err := upstream.CheckHost(parsedURL.Hostname()); err != nil {
+		return upstreamError(c, err)
+	}
+	if err := upstream.CheckProxy(input.Proxy); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	if strings.HasSuffix(parsedURL.Path, ".m3u8") {
-		return proxy.ManifestProxy(c, input)
+		c.Set("route", "manifest")
+		return upstreamError(c, proxy.ManifestProxy(c, input))
+	}
+	c.Set("route", "segment")
+	return upstreamError(c, proxy.TsProxy(c, input))
+}
+
+// upstreamError answers with 403 when the upstream policy refused a fetch, which may only
+// show once a host name has been resolved.
+func upstreamError(c echo.Context, err error) error {
+	if !errors.Is(err, upstream.ErrBlocked) {
+		return err
 	}
-	return proxy.TsProxy(c, input)
+	log.WithField("remote_ip", c.RealIP()).Warn("Blocked upstream request: ", err)
+	return echo.NewHTTPError(http.StatusForbidden, err.Error())
 }
 
 func handleHealth(c echo.Context) error {
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/recording"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scheduleCmd = &cobra.Command{
+		Use:   "schedule",
+		Short: "Schedule a recording on a running hls-proxy",
+		Long:  "schedule submits a recording job to the /api/recordings endpoint of a running hls-proxy server, authenticating with ADMIN_TOKEN.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req, err := buildJobRequest()
+			if err != nil {
+				return err
+			}
+			job, err := submitJob(scheduleValues.server, req)
+			if err != nil {
+				return err
+			}
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(job)
+		},
+	}
+
+	scheduleValues struct {
+		server   string
+		url      string
+		headers  []string
+		start    string
+		duration time.Duration
+		variant  string
+	}
+)
+
+func init() {
+	scheduleCmd.Flags().StringVar(&scheduleValues.server, "server", defaultServerURL(), "Base URL of the hls-proxy server that runs the job")
+	scheduleCmd.Flags().StringVar(&scheduleValues.url, "url", "", "Playlist URL to record")
+	scheduleCmd.Flags().StringArrayVar(&scheduleValues.headers, "header", nil, "Upstream header as \"Name: value\" (repeatable)")
+	scheduleCmd.Flags().StringVar(&scheduleValues.start, "start", "now", "Start time as RFC3339, a delay such as 10m, or \"now\"")
+	scheduleCmd.Flags().DurationVar(&scheduleValues.duration, "duration", time.Hour, "How long to record")
+	scheduleCmd.Flags().StringVar(&scheduleValues.variant, "variant", "best", "Variant to record: best, worst, <height>p or an exact bandwidth")
+	_ = scheduleCmd.MarkFlagRequired("url")
+	rootCmd.AddCommand(scheduleCmd)
+}
+
+func buildJobRequest() (recording.JobRequest, error) {
+	req := recording.JobRequest{
+		Url:      scheduleValues.url,
+		Duration: recording.Duration(scheduleValues.duration),
+		Variant:  scheduleValues.variant,
+	}
+
+	start, err := parseStart(scheduleValues.start)
+	if err != nil {
+		return req, err
+	}
+	req.Start = start
+
+	req.Headers, err = parseHeaderFlags(scheduleValues.headers)
+	return req, err
+}
+
+// parseHeaderFlags turns repeated "Name: value" flags into a header map.
+func parseHeaderFlags(headers []string) (map[string]string, error) {
+	var parsed map[string]string
+	for _, header := range headers {
+		name, value, found := strings.Cut(header, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", header)
+		}
+		if parsed == nil {
+			parsed = make(map[string]string)
+		}
+		parsed[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
+func parseStart(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "now") {
+		return time.Time{}, nil
+	}
+	if delay, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(delay), nil
+	}
+	start, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid start %q: use RFC3339, a duration or \"now\"", value)
+	}
+	return start, nil
+}
+
+func submitJob(server string, req recording.JobRequest) (*recording.Job, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimRight(server, "/") + "/api/recordings"
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	// the recordings API takes the same token as the admin API, read from the environment
+	if token := config.Settings.AdminToken; token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("schedule failed: status %d: %s", resp.StatusCode, strings.TrimSpace(string(payload)))
+	}
+
+	var job recording.Job
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func defaultServerURL() string {
+	host := config.Settings.Host
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("http://%s:%s", host, config.Settings.Port)
+}
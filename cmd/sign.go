@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/parsing"
+	"github.com/bariiss/hls-proxy/recording"
+	"github.com/bariiss/hls-proxy/signing"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	signCmd = &cobra.Command{
+		Use:   "sign",
+		Short: "Mint a signed proxy URL for a stream",
+		Long:  "sign prints a proxy URL for a stream, signed with URL_SIGNING_SECRET and valid for --ttl. The token is encrypted when INPUT_TOKEN_KEYS is set.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if config.Settings.URLSigningSecret == "" {
+				return errors.New("URL_SIGNING_SECRET is not set")
+			}
+			if err := configureInputTokens(config.Settings.InputTokenKeys, config.Settings.InputTokenGrace); err != nil {
+				return err
+			}
+			headers, err := parseHeaderFlags(signValues.headers)
+			if err != nil {
+				return err
+			}
+			cookies, err := parseCookieFlags(signValues.cookies)
+			if err != nil {
+				return err
+			}
+			input := &model.Input{
+				Url:       signValues.url,
+				Referer:   signValues.referer,
+				Origin:    signValues.origin,
+				UserAgent: signValues.userAgent,
+				Headers:   headers,
+				Cookies:   cookies,
+				Proxy:     signValues.proxy,
+			}
+
+			signing.Configure(config.Settings.URLSigningSecret, config.Settings.URLSigningTTL)
+			signed, _ := signedEntryURL(signValues.server, input, signValues.ttl)
+			fmt.Fprintln(cmd.OutOrStdout(), signed)
+			return nil
+		},
+	}
+
+	signValues struct {
+		server    string
+		url       string
+		referer   string
+		origin    string
+		userAgent string
+		headers   []string
+		cookies   []string
+		proxy     string
+		ttl       time.Duration
+	}
+)
+
+func init() {
+	signCmd.Flags().StringVar(&signValues.server, "server", defaultServerURL(), "Base URL players reach the proxy at")
+	signCmd.Flags().StringVar(&signValues.url, "url", "", "Playlist URL to proxy")
+	signCmd.Flags().StringVar(&signValues.referer, "referer", "", "Referer sent upstream")
+	signCmd.Flags().StringVar(&signValues.origin, "origin", "", "Origin sent upstream")
+	signCmd.Flags().StringVar(&signValues.userAgent, "user-agent", "", "User-Agent sent upstream instead of the configured one")
+	signCmd.Flags().StringArrayVar(&signValues.headers, "header", nil, "Upstream header as \"Name: value\" (repeatable)")
+	signCmd.Flags().StringArrayVar(&signValues.cookies, "cookie", nil, "Upstream cookie as \"name=value\" (repeatable)")
+	signCmd.Flags().StringVar(&signValues.proxy, "proxy", "", "Named upstream proxy the stream is fetched through")
+	signCmd.Flags().DurationVar(&signValues.ttl, "ttl", config.Settings.URLSigningTTL, "How long the URL stays valid")
+	_ = signCmd.MarkFlagRequired("url")
+	rootCmd.AddCommand(signCmd)
+}
+
+// configureInputTokens enables encrypted input tokens when INPUT_TOKEN_KEYS lists keys,
+// comma separated with the current key first.
+func configureInputTokens(keys string, grace time.Duration) error {
+	if keys == "" {
+		return nil
+	}
+	if err := parsing.ConfigureTokenKeys(strings.Split(keys, ","), grace); err != nil {
+		return fmt.Errorf("input token keys: %w", err)
+	}
+	log.Info("Emitting encrypted input tokens")
+	return nil
+}
+
+// parseCookieFlags turns repeated "name=value" flags into a cookie map.
+func parseCookieFlags(cookies []string) (map[string]string, error) {
+	var parsed map[string]string
+	for _, cookie := range cookies {
+		name, value, found := strings.Cut(cookie, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid cookie %q, expected \"name=value\"", cookie)
+		}
+		if parsed == nil {
+			parsed = make(map[string]string)
+		}
+		parsed[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
+// signedEntryURL is the proxy URL for input under server, valid for ttl.
+func signedEntryURL(server string, input *model.Input, ttl time.Duration) (string, time.Time) {
+	token := parsing.EncodeToken(input)
+	expires := time.Now().Add(ttl)
+	return strings.TrimRight(server, "/") + "/" + parsing.TokenPath(token, input.Url) + "?" + signing.Query(token, expires, nil), expires
+}
+
+// signRequest is the payload of POST /api/admin/sign.
+type signRequest struct {
+	Url       string             `json:"url"`
+	Referer   string             `json:"referer"`
+	Origin    string             `json:"origin"`
+	UserAgent string             `json:"user_agent"`
+	Headers   map[string]string  `json:"headers"`
+	Cookies   map[string]string  `json:"cookies"`
+	Proxy     string             `json:"proxy"`
+	TTL       recording.Duration `json:"ttl"`
+}
+
+func handleSignURL(c echo.Context) error {
+	if !signing.Enabled() {
+		return echo.NewHTTPError(http.StatusConflict, "URL signing is disabled; set URL_SIGNING_SECRET")
+	}
+	var req signRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if strings.TrimSpace(req.Url) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "url is required")
+	}
+	ttl := time.Duration(req.TTL)
+	if ttl <= 0 {
+		ttl = signing.TTL()
+	}
+
+	signed, expires := signedEntryURL(requestBaseURL(c), &model.Input{
+		Url:       req.Url,
+		Referer:   req.Referer,
+		Origin:    req.Origin,
+		UserAgent: req.UserAgent,
+		Headers:   req.Headers,
+		Cookies:   req.Cookies,
+		Proxy:     req.Proxy,
+	}, ttl)
+	return c.JSON(http.StatusOK, map[string]any{"url": signed, "expires": expires})
+}
+
+// requestBaseURL is the proxy's address as the caller reached it.
+func requestBaseURL(c echo.Context) string {
+	scheme := "http"
+	if model.Configuration.UseHttps {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request().Host
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/streams"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamResponse is a registered stream along with the playlist URL players should open.
+type streamResponse struct {
+	streams.Stream
+	Playlist string `json:"playlist"`
+}
+
+// registerStreamRoutes serves registered streams under /s/<id>/ and, when ADMIN_TOKEN is
+// set, mounts the registry API behind it. Registering a stream makes the proxy fetch any
+// origin for anyone holding the short URL, so the API is never open.
+func registerStreamRoutes(e *echo.Echo) {
+	e.GET("/s/:id/:name", handleStreamRequest)
+
+	token := model.Configuration.AdminToken
+	if token == "" {
+		log.Debug("Stream registry API disabled; set ADMIN_TOKEN to enable it")
+		return
+	}
+	group := e.Group("/api/streams", requireAdminToken(token))
+	group.GET("", handleListStreams)
+	group.POST("", handleCreateStream)
+	group.GET("/:id", handleGetStream)
+	group.DELETE("/:id", handleDeleteStream)
+}
+
+func handleStreamRequest(c echo.Context) error {
+	input, err := streams.Resolve(c.Param("id"), c.Param("name"))
+	if err != nil {
+		return streamError(err)
+	}
+	return serveInput(c, input)
+}
+
+func handleListStreams(c echo.Context) error {
+	list, err := streams.List()
+	if err != nil {
+		return streamError(err)
+	}
+	out := make([]streamResponse, 0, len(list))
+	for _, stream := range list {
+		out = append(out, newStreamResponse(c, stream))
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func handleCreateStream(c echo.Context) error {
+	var def streams.Definition
+	if err := c.Bind(&def); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid stream definition")
+	}
+
+	stream, err := streams.Register(def)
+	if err != nil {
+		return streamError(err)
+	}
+	return c.JSON(http.StatusCreated, newStreamResponse(c, stream))
+}
+
+func handleGetStream(c echo.Context) error {
+	stream, err := streams.Get(c.Param("id"))
+	if err != nil {
+		return streamError(err)
+	}
+	return c.JSON(http.StatusOK, newStreamResponse(c, stream))
+}
+
+func handleDeleteStream(c echo.Context) error {
+	if err := streams.Delete(c.Param("id")); err != nil {
+		return streamError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func newStreamResponse(c echo.Context, stream streams.Stream) streamResponse {
+	return streamResponse{Stream: stream, Playlist: requestBaseURL(c) + "/" + streams.EntryPath(stream.ID)}
+}
+
+func streamError(err error) error {
+	switch {
+	case errors.Is(err, streams.ErrStreamNotFound), errors.Is(err, streams.ErrUnknownChild):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, streams.ErrInvalidStream):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, streams.ErrRegistryDisabled):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	default:
+		return err
+	}
+}
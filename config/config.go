@@ -13,11 +13,31 @@ type Values struct {
 	SegmentCount               int
 	SegmentStore               bool
 	SegmentStorageDir          string
+	SegmentStorePersist        bool
+	SegmentStoreMaxBytes       int64
+	SegmentStoreMinFreeBytes   int64
+	SegmentStoreBackend        string
+	S3Endpoint                 string
+	S3Bucket                   string
+	S3Prefix                   string
+	S3Region                   string
+	S3AccessKey                string
+	S3SecretKey                string
+	S3SessionToken             string
+	S3PathStyle                bool
+	StateBackend               string
+	RedisURL                   string
+	RedisPrefix                string
+	RedisSegmentMaxBytes       int64
 	SegmentCache               bool
+	SegmentCacheMaxBytes       int64
 	SegmentIdleEnabled         bool
 	SegmentIdleTimeout         time.Duration
 	SegmentIdleRequireSegments bool
 	SegmentBackgroundFetch     bool
+	ManifestPoll               bool
+	ManifestCacheFraction      float64
+	ManifestCacheStaticTTL     time.Duration
 	Throttle                   int
 	JanitorInterval            time.Duration
 	Attempts                   int
@@ -34,6 +54,27 @@ type Values struct {
 	RetryRequestDelay          time.Duration
 	RetryClipDelay             time.Duration
 	UserAgent                  string
+	RecordingDir               string
+	StreamRegistryDir          string
+	Metrics                    bool
+	TracingEndpoint            string
+	TracingSampleRatio         float64
+	TracingPropagate           bool
+	URLSigningSecret           string
+	URLSigningTTL              time.Duration
+	InputTokenKeys             string
+	InputTokenGrace            time.Duration
+	InputTokenRequireEncrypted bool
+	AdminToken                 string
+	UpstreamAllow              string
+	UpstreamDeny               string
+	UpstreamAllowPrivate       bool
+	UpstreamTLSInsecure        string
+	UpstreamCABundle           string
+	UpstreamClientCerts        string
+	UpstreamProxy              string
+	UpstreamProxies            string
+	UpstreamProxyRules         string
 }
 
 var Settings = load()
@@ -44,11 +85,31 @@ func load() Values {
 		SegmentCount:               getInt("SEGMENTS", 30),
 		SegmentStore:               getSegmentStoreFlag(),
 		SegmentStorageDir:          getString("SEGMENT_STORAGE_DIR", "./segments"),
+		SegmentStorePersist:        getBool("SEGMENT_STORE_PERSIST", false),
+		SegmentStoreMaxBytes:       getInt64("SEGMENT_STORE_MAX_BYTES", 0),
+		SegmentStoreMinFreeBytes:   getInt64("SEGMENT_STORE_MIN_FREE_BYTES", 512<<20),
+		SegmentStoreBackend:        getString("SEGMENT_STORE_BACKEND", "file"),
+		S3Endpoint:                 getString("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Bucket:                   getString("S3_BUCKET", ""),
+		S3Prefix:                   getString("S3_PREFIX", "segments"),
+		S3Region:                   getString("S3_REGION", getString("AWS_REGION", "us-east-1")),
+		S3AccessKey:                getString("S3_ACCESS_KEY", os.Getenv("AWS_ACCESS_KEY_ID")),
+		S3SecretKey:                getString("S3_SECRET_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		S3SessionToken:             getString("S3_SESSION_TOKEN", os.Getenv("AWS_SESSION_TOKEN")),
+		S3PathStyle:                getBool("S3_PATH_STYLE", false),
+		StateBackend:               getString("STATE_BACKEND", "memory"),
+		RedisURL:                   getString("REDIS_URL", "redis://127.0.0.1:6379/0"),
+		RedisPrefix:                getString("REDIS_PREFIX", "hls-proxy"),
+		RedisSegmentMaxBytes:       getInt64("REDIS_SEGMENT_MAX_BYTES", 4<<20),
 		SegmentCache:               getSegmentCacheFlag(),
+		SegmentCacheMaxBytes:       getInt64("SEGMENT_CACHE_MAX_BYTES", 256<<20),
 		SegmentIdleEnabled:         getBool("SEGMENT_IDLE_ENABLED", true),
 		SegmentIdleTimeout:         getDuration("SEGMENT_IDLE_TIMEOUT", 20*time.Second),
 		SegmentIdleRequireSegments: getBool("SEGMENT_IDLE_REQUIRE_SEGMENTS", false),
 		SegmentBackgroundFetch:     getBool("SEGMENT_BACKGROUND_FETCH", false),
+		ManifestPoll:               getBool("MANIFEST_POLL", false),
+		ManifestCacheFraction:      getFloat("MANIFEST_CACHE_FRACTION", 0.5),
+		ManifestCacheStaticTTL:     getDuration("MANIFEST_CACHE_STATIC_TTL", 10*time.Second),
 		Throttle:                   getInt("THROTTLE", 5),
 		JanitorInterval:            getDuration("JANITOR_INTERVAL", 20*time.Second),
 		Attempts:                   getInt("ATTEMPTS", 3),
@@ -65,6 +126,27 @@ func load() Values {
 		UserAgent:                  getString("HTTP_USER_AGENT", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36"),
 		UseHTTPS:                   getBool("HTTPS", false),
 		DecryptSegments:            getBool("DECRYPT", false),
+		RecordingDir:               getString("RECORDING_DIR", "./recordings"),
+		StreamRegistryDir:          getString("STREAM_REGISTRY_DIR", "./streams"),
+		AdminToken:                 getString("ADMIN_TOKEN", ""),
+		Metrics:                    getBool("METRICS", true),
+		TracingEndpoint:            getString("TRACING_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		TracingSampleRatio:         getFloat("TRACING_SAMPLE_RATIO", 1),
+		TracingPropagate:           getBool("TRACING_PROPAGATE", false),
+		URLSigningSecret:           getString("URL_SIGNING_SECRET", ""),
+		URLSigningTTL:              getDuration("URL_SIGNING_TTL", 6*time.Hour),
+		InputTokenKeys:             getString("INPUT_TOKEN_KEYS", ""),
+		InputTokenGrace:            getDuration("INPUT_TOKEN_GRACE", 24*time.Hour),
+		InputTokenRequireEncrypted: getBool("INPUT_TOKEN_REQUIRE_ENCRYPTED", false),
+		UpstreamAllow:              getString("UPSTREAM_ALLOW", ""),
+		UpstreamDeny:               getString("UPSTREAM_DENY", ""),
+		UpstreamAllowPrivate:       getBool("UPSTREAM_ALLOW_PRIVATE", false),
+		UpstreamTLSInsecure:        getString("UPSTREAM_TLS_INSECURE", ""),
+		UpstreamCABundle:           getString("UPSTREAM_CA_BUNDLE", ""),
+		UpstreamClientCerts:        getString("UPSTREAM_CLIENT_CERTS", ""),
+		UpstreamProxy:              getString("UPSTREAM_PROXY", ""),
+		UpstreamProxies:            getString("UPSTREAM_PROXIES", ""),
+		UpstreamProxyRules:         getString("UPSTREAM_PROXY_RULES", ""),
 	}
 }
 
@@ -122,6 +204,30 @@ func getInt(envKey string, fallback int) int {
 	return fallback
 }
 
+func getFloat(envKey string, fallback float64) float64 {
+	if value := os.Getenv(envKey); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Warnf("Invalid number provided for %s: %s. Falling back to default %g", envKey, value, fallback)
+			return fallback
+		}
+		return parsed
+	}
+	return fallback
+}
+
+func getInt64(envKey string, fallback int64) int64 {
+	if value := os.Getenv(envKey); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Warnf("Invalid integer provided for %s: %s. Falling back to default %d", envKey, value, fallback)
+			return fallback
+		}
+		return parsed
+	}
+	return fallback
+}
+
 func getBool(envKey string, fallback bool) bool {
 	if value := os.Getenv(envKey); value != "" {
 		parsed, err := strconv.ParseBool(value)
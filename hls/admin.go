@@ -0,0 +1,125 @@
+package hls
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ManifestInfo describes one manifest the proxy is tracking, for the admin API.
+type ManifestInfo struct {
+	Key            string    `json:"key"`
+	PlaylistID     string    `json:"playlist_id"`
+	LastAccess     time.Time `json:"last_access"`
+	Segments       int       `json:"segments"`
+	ServedSegments bool      `json:"served_segments"`
+	Cache          Occupancy `json:"cache"`
+	Store          Occupancy `json:"store"`
+}
+
+// PrefetchQueue describes the clips the prefetcher holds for one playlist.
+type PrefetchQueue struct {
+	PlaylistID string    `json:"playlist_id"`
+	Clips      int       `json:"clips"`
+	Fetched    int       `json:"fetched"`
+	Expires    time.Time `json:"expires"`
+}
+
+func (h *manifestHistory) info(key string) ManifestInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return ManifestInfo{
+		Key:            key,
+		PlaylistID:     h.playlistID,
+		LastAccess:     h.lastAccess,
+		Segments:       len(h.order),
+		ServedSegments: h.segmentsRequested,
+	}
+}
+
+// ListManifests reports every manifest history along with what the cache and store hold
+// for its playlist, most recently used first.
+func ListManifests() []ManifestInfo {
+	cacheUsage := SegmentCacheUsage()
+	storeUsage := SegmentStoreUsage()
+
+	items := histories.Items()
+	manifests := make([]ManifestInfo, 0, len(items))
+	for key, history := range items {
+		if history == nil {
+			continue
+		}
+		info := history.info(key)
+		info.Cache = cacheUsage[info.PlaylistID]
+		info.Store = storeUsage[info.PlaylistID]
+		manifests = append(manifests, info)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].LastAccess.After(manifests[j].LastAccess)
+	})
+	return manifests
+}
+
+// PurgeManifest drops a manifest and everything held for it, including stored segments of
+// a persistent store. It reports whether the manifest was known.
+func PurgeManifest(prefetcher *Prefetcher, key string) bool {
+	history, ok := histories.Get(key)
+	if !ok || history == nil {
+		return false
+	}
+	purgeManifest(prefetcher, key, history, true)
+	return true
+}
+
+// PurgeAllManifests drops every manifest, then clears whatever the cache still holds for
+// playlists no history refers to. It returns the number of manifests purged.
+func PurgeAllManifests(prefetcher *Prefetcher) int {
+	purged := 0
+	for key, history := range histories.Items() {
+		if history == nil {
+			continue
+		}
+		purgeManifest(prefetcher, key, history, true)
+		purged++
+	}
+	ResetSegmentCache()
+	for manifestID := range SegmentStoreUsage() {
+		if err := RemoveManifestSegments(manifestID); err != nil {
+			log.Warnf("Failed to remove persisted segments for %s: %v", manifestID, err)
+		}
+	}
+	return purged
+}
+
+// Queues reports the playlists the prefetcher is holding clips for.
+func (p *Prefetcher) Queues() []PrefetchQueue {
+	if p == nil {
+		return nil
+	}
+	items := p.playlistInfo.Items()
+	queues := make([]PrefetchQueue, 0, len(items))
+	for playlistID, item := range items {
+		if item.Data == nil {
+			continue
+		}
+		queues = append(queues, PrefetchQueue{
+			PlaylistID: playlistID,
+			Clips:      len(item.Data.playlistClips),
+			Fetched:    item.Data.fetchedClips.Count(),
+			Expires:    item.Expiration,
+		})
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].PlaylistID < queues[j].PlaylistID
+	})
+	return queues
+}
+
+// InFlight reports how many clips are being prefetched right now.
+func (p *Prefetcher) InFlight() int {
+	if p == nil {
+		return 0
+	}
+	return p.currentlyPrefetching.Cardinality()
+}
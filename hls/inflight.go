@@ -0,0 +1,69 @@
+package hls
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// segmentFetches tracks segment downloads that are currently talking to the origin, keyed
+// by manifest and segment URL, so players and the prefetcher share a single upstream fetch.
+var segmentFetches singleflight.Group
+
+// FetchedSegment is a segment body as downloaded from the origin, with the Content-Type the
+// origin sent, if any.
+type FetchedSegment struct {
+	Data        []byte
+	ContentType string
+}
+
+// FetchSegmentOnce runs fetch unless the same segment of the same manifest is already being
+// downloaded, in which case it waits for that download instead. The caller that performs the
+// download stores the result in the segment cache and store, so it lands there exactly once.
+// The returned bool reports whether this caller did the upstream fetch.
+func FetchSegmentOnce(manifestID, clipUrl string, fetch func() (FetchedSegment, error)) (FetchedSegment, bool, error) {
+	leader := false
+	result, err, _ := segmentFetches.Do(manifestID+"\x00"+clipUrl, func() (any, error) {
+		leader = true
+		segment, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		persistSegment(manifestID, clipUrl, segment.Data)
+		return segment, nil
+	})
+	if err != nil {
+		return FetchedSegment{}, leader, err
+	}
+	return result.(FetchedSegment), leader, nil
+}
+
+// KeepsSegments reports whether fetched segments are kept anywhere, by the segment cache or
+// the segment store. When they are not, a player's fetch has no reason to buffer the body.
+func KeepsSegments() bool {
+	_, cached := activeCache()
+	storeMu.RLock()
+	stored := storeEnabled
+	storeMu.RUnlock()
+	return cached || stored
+}
+
+func persistSegment(manifestID, clipUrl string, data []byte) {
+	SaveSegmentCache(manifestID, clipUrl, data)
+
+	storeMu.RLock()
+	shared := storeShared
+	storeMu.RUnlock()
+	if shared {
+		// an upload to the bucket would hold up the player and every joined fetch, so it
+		// happens after the segment is served; followers read the memory cache meanwhile
+		go saveSegment(manifestID, clipUrl, data)
+		return
+	}
+	saveSegment(manifestID, clipUrl, data)
+}
+
+func saveSegment(manifestID, clipUrl string, data []byte) {
+	if err := SaveSegment(manifestID, clipUrl, data); err != nil {
+		log.Warn("Failed to persist segment ", clipUrl, ": ", err)
+	}
+}
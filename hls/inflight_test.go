@@ -0,0 +1,50 @@
+package hls
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchSegmentOnceSharesTheContentType(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]FetchedSegment, 2)
+	leaders := make([]bool, 2)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], leaders[0], _ = FetchSegmentOnce("manifest", "https://origin/seg.ts", func() (FetchedSegment, error) {
+			close(started)
+			<-release
+			return FetchedSegment{Data: []byte("segment"), ContentType: "video/mp2t"}, nil
+		})
+	}()
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		results[1], leaders[1], err = FetchSegmentOnce("manifest", "https://origin/seg.ts", func() (FetchedSegment, error) {
+			t.Error("the follower must join the leader's fetch")
+			return FetchedSegment{}, nil
+		})
+		require.NoError(t, err)
+	}()
+	// give the follower time to join before the leader finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, []bool{true, false}, leaders)
+	for _, result := range results {
+		assert.Equal(t, "video/mp2t", result.ContentType)
+		assert.Equal(t, "segment", string(result.Data))
+	}
+}
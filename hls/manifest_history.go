@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/bariiss/hls-proxy/metrics"
 	"github.com/bariiss/hls-proxy/model"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,6 +21,7 @@ type manifestSegment struct {
 
 type manifestHistory struct {
 	mu                sync.Mutex
+	key               string
 	playlistID        string
 	segments          map[string]*manifestSegment
 	order             []string
@@ -42,6 +44,7 @@ func getManifestHistory(key string) *manifestHistory {
 
 func createManifestHistory(key string) *manifestHistory {
 	history := &manifestHistory{
+		key:        key,
 		segments:   make(map[string]*manifestSegment),
 		order:      make([]string, 0),
 		lastAccess: time.Now(),
@@ -68,8 +71,8 @@ func (h *manifestHistory) currentPlaylistID() string {
 func (h *manifestHistory) merge(entries []*manifestSegment, limit int) []*manifestSegment {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.lastAccess = time.Now()
 
+	var fresh []*manifestSegment
 	for _, entry := range entries {
 		if entry == nil || entry.ClipURL == "" {
 			continue
@@ -85,11 +88,11 @@ func (h *manifestHistory) merge(entries []*manifestSegment, limit int) []*manife
 			continue
 		}
 
-		entry.Sequence = h.nextSeq
-		h.nextSeq++
 		h.segments[entry.ClipURL] = entry
 		h.order = append(h.order, entry.ClipURL)
+		fresh = append(fresh, entry)
 	}
+	h.assignSequencesLocked(fresh, nil)
 
 	if limit > 0 && len(h.order) > limit {
 		drop := len(h.order) - limit
@@ -97,7 +100,9 @@ func (h *manifestHistory) merge(entries []*manifestSegment, limit int) []*manife
 			clip := h.order[i]
 			delete(h.segments, clip)
 		}
+		dropped := h.order[:drop]
 		h.order = append([]string(nil), h.order[drop:]...)
+		h.assignSequencesLocked(nil, dropped)
 	}
 
 	combined := make([]*manifestSegment, 0, len(h.order))
@@ -112,10 +117,39 @@ func (h *manifestHistory) merge(entries []*manifestSegment, limit int) []*manife
 	return combined
 }
 
+// assignSequencesLocked numbers newly seen segments. With shared state the numbers come from
+// the other replicas' view of the manifest, so a player moving between them sees one sequence.
+func (h *manifestHistory) assignSequencesLocked(fresh []*manifestSegment, dropped []string) {
+	if state := currentSharedState(); state != nil && h.key != "" {
+		clips := make([]string, len(fresh))
+		for i, entry := range fresh {
+			clips[i] = entry.ClipURL
+		}
+		sequences, err := state.AssignSequences(h.key, clips, dropped)
+		if err == nil && len(sequences) == len(fresh) {
+			for i, entry := range fresh {
+				entry.Sequence = sequences[i]
+				h.nextSeq = max(h.nextSeq, sequences[i]+1)
+			}
+			return
+		}
+		if err != nil {
+			log.Warn("Failed to assign shared segment sequences, numbering locally: ", err)
+		}
+	}
+
+	for _, entry := range fresh {
+		entry.Sequence = h.nextSeq
+		h.nextSeq++
+	}
+}
+
 func (h *manifestHistory) touch() {
+	now := time.Now()
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.lastAccess = time.Now()
+	h.lastAccess = now
+	h.mu.Unlock()
+	shareTouch(h.key, now)
 }
 
 func (h *manifestHistory) inactiveSince(cutoff time.Time) bool {
@@ -139,12 +173,29 @@ func (h *manifestHistory) reset() {
 }
 
 func (h *manifestHistory) markSegmentRequested() {
+	now := time.Now()
+	h.mu.Lock()
+	h.lastAccess = now
+	h.segmentsRequested = true
+	h.mu.Unlock()
+	shareTouch(h.key, now)
+}
+
+func (h *manifestHistory) markSegmentFetched() {
 	h.mu.Lock()
-	h.lastAccess = time.Now()
 	h.segmentsRequested = true
 	h.mu.Unlock()
 }
 
+func (h *manifestHistory) idleFor() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastAccess.IsZero() {
+		return 0
+	}
+	return time.Since(h.lastAccess)
+}
+
 func (h *manifestHistory) hasServedSegments() bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -169,6 +220,27 @@ func RecordSegmentRequest(key string) {
 	history.markSegmentRequested()
 }
 
+// recordPrefetchedSegment flags a manifest as having served segments without counting
+// the background fetch as viewer activity, so idle streams can still be purged.
+func recordPrefetchedSegment(key string) {
+	if key == "" {
+		return
+	}
+	if history, ok := histories.Get(key); ok {
+		history.markSegmentFetched()
+	}
+}
+
+// ManifestIdleFor reports how long a manifest has gone without player requests.
+// The second result is false once the manifest history has been purged.
+func ManifestIdleFor(key string) (time.Duration, bool) {
+	history, ok := histories.Get(key)
+	if !ok || history == nil {
+		return 0, false
+	}
+	return history.idleFor(), true
+}
+
 // StartManifestInactivityJanitor purges inactive manifests and their persisted segments.
 func StartManifestInactivityJanitor(prefetcher *Prefetcher, ttl time.Duration) {
 	if ttl <= 0 {
@@ -186,6 +258,7 @@ func StartManifestInactivityJanitor(prefetcher *Prefetcher, ttl time.Duration) {
 }
 
 func purgeInactiveManifests(prefetcher *Prefetcher, ttl time.Duration) {
+	metrics.JanitorRuns.WithLabelValues("manifest").Inc()
 	cutoff := time.Now().Add(-ttl)
 	for key, history := range histories.Items() {
 		if history == nil || !history.inactiveSince(cutoff) {
@@ -196,23 +269,38 @@ func purgeInactiveManifests(prefetcher *Prefetcher, ttl time.Duration) {
 			continue
 		}
 
-		playlistID := history.currentPlaylistID()
-		history.reset()
-		histories.Remove(key)
-
-		if playlistID == "" {
+		// another replica may still be serving this manifest to players
+		if at, ok := sharedLastAccess(key); ok && at.After(cutoff) {
 			continue
 		}
 
-		log.Infof("Purging inactive manifest %s", playlistID)
-		if prefetcher != nil {
-			prefetcher.RemovePlaylist(playlistID)
-		}
+		purgeManifest(prefetcher, key, history, idleRemovesStoredSegments())
+	}
+}
+
+// purgeManifest forgets a manifest history and drops everything held for its playlist:
+// prefetched clips, cached segments and, when removeStored is set, stored segments.
+func purgeManifest(prefetcher *Prefetcher, key string, history *manifestHistory, removeStored bool) {
+	playlistID := history.currentPlaylistID()
+	history.reset()
+	histories.Remove(key)
+	shareForget(key)
+	metrics.ManifestsPurged.Inc()
+
+	if playlistID == "" {
+		return
+	}
+
+	log.Infof("Purging manifest %s", playlistID)
+	if prefetcher != nil {
+		prefetcher.RemovePlaylist(playlistID)
+	}
 
+	if removeStored {
 		if err := RemoveManifestSegments(playlistID); err != nil {
 			log.Warnf("Failed to remove persisted segments for %s: %v", playlistID, err)
 		}
-
-		ClearSegmentCache(playlistID)
 	}
+
+	ClearSegmentCache(playlistID)
 }
@@ -1,7 +1,9 @@
 package hls
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -10,16 +12,46 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/http_retry"
 	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/parsing"
+	"github.com/bariiss/hls-proxy/signing"
+	"github.com/bariiss/hls-proxy/streams"
+	"github.com/bariiss/hls-proxy/tracing"
+	"github.com/bariiss/hls-proxy/upstream"
 	"github.com/cristalhq/base64"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var counter atomic.Int32
 var re = regexp.MustCompile(`(?i)URI=["']([^"']+)["']`)
 
-func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *model.Input, requestHost string) (string, error) {
+// ErrManifestInactive is returned by RefreshM3u8 once the manifest history has been purged.
+var ErrManifestInactive = errors.New("manifest is no longer active")
+
+func ModifyM3u8(ctx context.Context, m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *model.Input, requestHost string) (string, error) {
+	return modifyM3u8(ctx, m3u8, host_url, prefetcher, input, requestHost, false)
+}
+
+// RefreshM3u8 merges a background fetch of a media playlist into the manifest history and
+// queues its segments for prefetching, without counting as player activity. Nothing is
+// rewritten, since no player reads the result.
+func RefreshM3u8(ctx context.Context, m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *model.Input) error {
+	_, err := modifyM3u8(ctx, m3u8, host_url, prefetcher, input, "", true)
+	return err
+}
+
+func modifyM3u8(ctx context.Context, m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *model.Input, requestHost string, background bool) (result string, err error) {
+	ctx, span := tracing.Start(ctx, "ModifyM3u8", attribute.Bool("manifest.background", background))
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+
 	var newManifest = strings.Builder{}
 	var host = resolveProxyHost(requestHost)
 	manifestKey := input.Encoded
@@ -41,8 +73,11 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 		masterProxyUrl = "https://" + host + "/"
 	}
 
-	newManifest.Grow(len(m3u8))
 	if strings.Contains(m3u8, "RESOLUTION=") {
+		if background {
+			return "", nil
+		}
+		newManifest.Grow(len(m3u8))
 		manifestAddr := masterProxyUrl
 		for line := range strings.SplitSeq(strings.TrimRight(m3u8, "\n"), "\n") {
 			if len(line) == 0 {
@@ -73,7 +108,16 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 	}
 
 	//most likely a master playlist containing the video elements
-	history := getManifestHistory(manifestKey)
+	var history *manifestHistory
+	if background {
+		existing, ok := histories.Get(manifestKey)
+		if !ok || existing == nil {
+			return "", ErrManifestInactive
+		}
+		history = existing
+	} else {
+		history = getManifestHistory(manifestKey)
+	}
 
 	var headerLines []string
 	mediaSequenceIndex := -1
@@ -117,12 +161,7 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 					if proxyUrl == "" {
 						return "", errors.New("missing key URI")
 					}
-					resp, err := http.Get(proxyUrl)
-					if err != nil {
-						return "", err
-					}
-					body, err := io.ReadAll(resp.Body)
-					resp.Body.Close()
+					body, err := fetchKey(ctx, proxyUrl, input)
 					if err != nil {
 						return "", err
 					}
@@ -169,10 +208,38 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 
 	playlistId := derivePlaylistID(history, manifestKey)
 	strId := playlistId
-	pidParam := url.QueryEscape(strId)
+	if endList {
+		MarkPlaylistComplete(strId)
+	}
 
 	clipUrls := make([]string, 0, len(combined))
+	for _, entry := range combined {
+		clipUrls = append(clipUrls, entry.ClipURL)
+	}
+	prefetcher.AddPlaylistToCache(strId, clipUrls, input)
+
+	if model.Configuration.SegmentBackgroundFetch && prefetcher != nil {
+		prefetcher.WarmPlaylist(strId)
+	}
 
+	if background {
+		if model.Configuration.Prefetch && prefetcher != nil {
+			upstreamClips := make([]string, 0, len(newSegments))
+			for _, entry := range newSegments {
+				upstreamClips = append(upstreamClips, entry.ClipURL)
+			}
+			prefetcher.QueueClips(strId, upstreamClips)
+		}
+		return "", nil
+	}
+
+	pidParam := strId
+	if input.StreamID == "" {
+		// the playlist ID is the manifest key, which would give the origin away next to encrypted tokens
+		pidParam = parsing.SealValue(strId)
+	}
+
+	newManifest.Grow(len(m3u8))
 	if len(combined) > 0 {
 		seqLine := "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(combined[0].Sequence)
 		if mediaSequenceIndex >= 0 {
@@ -197,8 +264,6 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 	}
 
 	for _, entry := range combined {
-		clipUrls = append(clipUrls, entry.ClipURL)
-
 		for _, tag := range entry.Tags {
 			if tag == "" {
 				continue
@@ -207,12 +272,12 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 			newManifest.WriteString("\n")
 		}
 
-		AddProxyUrl(tsAddr, entry.Line, false, parentUrl, &newManifest, input)
-		newManifest.WriteString("?pId=" + pidParam)
+		params := url.Values{"pId": {pidParam}}
 		if entry.HasKey {
-			newManifest.WriteString("&key=" + entry.DecryptionKey)
-			newManifest.WriteString("&iv=" + strconv.Itoa(entry.IV))
+			params.Set("key", entry.DecryptionKey)
+			params.Set("iv", strconv.Itoa(entry.IV))
 		}
+		newManifest.WriteString(proxyUrlForLine(tsAddr, entry.Line, parentUrl, input, params))
 		newManifest.WriteString("\n")
 	}
 
@@ -220,12 +285,6 @@ func ModifyM3u8(m3u8 string, host_url *url.URL, prefetcher *Prefetcher, input *m
 		newManifest.WriteString("#EXT-X-ENDLIST\n")
 	}
 
-	prefetcher.AddPlaylistToCache(strId, clipUrls)
-
-	if model.Configuration.SegmentBackgroundFetch && prefetcher != nil {
-		prefetcher.WarmPlaylist(strId)
-	}
-
 	return newManifest.String(), nil
 }
 
@@ -244,14 +303,7 @@ func handleUriTag(line string, parentUrl string, input *model.Input, newManifest
 		return
 	}
 
-	if input.Referer != "" {
-		proxyUrl += "|" + input.Referer
-	}
-	if input.Origin != "" {
-		proxyUrl += "|" + input.Origin
-	}
-	encodedProxyUrl := base64.StdEncoding.EncodeToString([]byte(proxyUrl))
-	newManifest.WriteString(strings.Replace(line, original, masterProxyUrl+encodedProxyUrl, 1))
+	newManifest.WriteString(strings.Replace(line, original, proxyUrlFor(masterProxyUrl, input, proxyUrl, nil), 1))
 }
 
 func getUrlForEmbeddedEntry(url string, parentUrl string) (string, string) {
@@ -268,20 +320,53 @@ func getUrlForEmbeddedEntry(url string, parentUrl string) (string, string) {
 }
 
 func AddProxyUrl(baseAddr string, url string, isManifest bool, parentUrl string, builder *strings.Builder, input *model.Input) {
+	builder.WriteString(proxyUrlForLine(baseAddr, url, parentUrl, input, nil))
+}
 
-	proxyUrl := url
-	if input.Referer != "" {
-		proxyUrl += "|" + input.Referer
+// proxyUrlForLine points the proxy at a playlist line, which may be relative to parentUrl.
+func proxyUrlForLine(baseAddr string, line string, parentUrl string, input *model.Input, params url.Values) string {
+	target := line
+	if !isAbsoluteURL(line) {
+		target = joinURL(parentUrl, line)
 	}
-	if input.Origin != "" {
-		proxyUrl += "|" + input.Origin
+	return proxyUrlFor(baseAddr, input, target, params)
+}
+
+// proxyUrlFor points the proxy at target, with params as its query. Registered streams get a
+// short per-stream path, which only reaches registered streams and so goes unsigned.
+// Otherwise, with signing enabled the URL carries a signed expiry covering params, so it is
+// the only way to reach target through the proxy. Expiries are rounded, so refreshes within
+// a window hand out the same URLs.
+func proxyUrlFor(baseAddr string, input *model.Input, target string, params url.Values) string {
+	if input.StreamID != "" {
+		child, err := streams.ChildPath(input.StreamID, target)
+		if err == nil {
+			return withQuery(baseAddr+child, params.Encode())
+		}
+		log.Warnf("Falling back to a token URL for stream %s: %v", input.StreamID, err)
 	}
-	builder.WriteString(baseAddr)
-	if isAbsoluteURL(url) {
-		builder.WriteString(base64.StdEncoding.EncodeToString([]byte(proxyUrl)))
-		return
+	token := encodeChildInput(input, target)
+	if !signing.Enabled() {
+		return withQuery(baseAddr+parsing.TokenPath(token, target), params.Encode())
 	}
-	builder.WriteString(base64.StdEncoding.EncodeToString([]byte(joinURL(parentUrl, proxyUrl))))
+	return baseAddr + parsing.TokenPath(token, target) + "?" + signing.Query(token, signing.Expires(time.Now()), params)
+}
+
+func withQuery(target, query string) string {
+	if query == "" {
+		return target
+	}
+	return target + "?" + query
+}
+
+// encodeChildInput encodes the input for a URL a playlist points at, encrypted when input
+// tokens are. The child carries the stream's Referer, Origin, User-Agent, headers, cookies
+// and proxy.
+func encodeChildInput(input *model.Input, target string) string {
+	child := *input
+	child.Url = target
+	child.Encoded = ""
+	return parsing.EncodeToken(&child)
 }
 
 func isAbsoluteURL(u string) bool {
@@ -297,6 +382,11 @@ func derivePlaylistID(history *manifestHistory, manifestKey string) string {
 	seed := manifestKey
 	if seed == "" {
 		seed = strconv.Itoa(int(counter.Add(1)))
+	} else if state := currentSharedState(); state != nil {
+		shared, err := state.PlaylistID(manifestKey, seed)
+		if err == nil && shared != "" {
+			seed = shared
+		}
 	}
 
 	return history.ensurePlaylistID(seed)
@@ -334,3 +424,40 @@ func isPlaylistHeader(line string) bool {
 		return false
 	}
 }
+
+// maxKeyBytes caps a fetched key body; AES-128 keys are 16 bytes.
+const maxKeyBytes = 4 << 10
+
+// fetchKey downloads the AES key a playlist points at, so segments can be decrypted here.
+func fetchKey(ctx context.Context, keyUrl string, input *model.Input) ([]byte, error) {
+	request, err := http.NewRequestWithContext(upstream.WithProxy(ctx, input.Proxy), "GET", keyUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	http_retry.SetBaseHeaders(request, input)
+	request, span := tracing.StartClient(request, "fetch key")
+	defer span.End()
+
+	// the shared client checks the upstream policy, also for redirects and resolved addresses
+	resp, err := http_retry.DefaultHttpClient.Do(request)
+	if err != nil {
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("fetch key: origin returned %s", resp.Status)
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyBytes+1))
+	if err == nil && len(body) > maxKeyBytes {
+		err = fmt.Errorf("fetch key: body larger than %d bytes", maxKeyBytes)
+	}
+	if err != nil {
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	return body, nil
+}
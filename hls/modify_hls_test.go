@@ -0,0 +1,131 @@
+package hls
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/parsing"
+	"github.com/bariiss/hls-proxy/signing"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddProxyUrlKeepsStreamHeaders(t *testing.T) {
+	input := &model.Input{
+		Url:       "https://origin.example/live/index.m3u8",
+		UserAgent: "Player/1.0",
+		Headers:   map[string]string{"Authorization": "Bearer x"},
+	}
+
+	var builder strings.Builder
+	AddProxyUrl("http://proxy/", "720p/index.m3u8", true, "https://origin.example/live", &builder, input)
+
+	proxyPath := strings.TrimPrefix(builder.String(), "http://proxy/")
+	assert.True(t, strings.HasSuffix(proxyPath, "/index.m3u8"), proxyPath)
+	child, _, err := parsing.ParseProxyPath(proxyPath)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example/live/720p/index.m3u8", child.Url)
+	assert.Equal(t, "Player/1.0", child.UserAgent)
+	assert.Equal(t, input.Headers, child.Headers)
+}
+
+func TestMasterPlaylistURLsExpireOneTTLAfterTheRewrite(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720\n720p/index.m3u8\n"
+	input := &model.Input{Url: "https://origin.example/live/master.m3u8"}
+	variantURL := func() *url.URL {
+		location, err := url.Parse(input.Url)
+		require.NoError(t, err)
+		out, err := ModifyM3u8(context.Background(), master, location, nil, input, "proxy.example")
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		variant, err := url.Parse(lines[len(lines)-1])
+		require.NoError(t, err)
+		return variant
+	}
+	verify := func(variant *url.URL) error {
+		_, token, err := parsing.ParseProxyPath(strings.TrimPrefix(variant.Path, "/"))
+		require.NoError(t, err)
+		return signing.Verify(token, variant.Query())
+	}
+	defer signing.Configure("", 0)
+
+	// the media playlist URL is signed once, when the master is rewritten
+	signing.Configure("secret", time.Hour)
+	before := time.Now()
+	variant := variantURL()
+	after := time.Now()
+	require.NoError(t, verify(variant))
+	expires, err := strconv.ParseInt(variant.Query().Get(signing.ExpiresParam), 10, 64)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, expires, signing.Expires(before).Unix())
+	assert.LessOrEqual(t, expires, signing.Expires(after).Unix())
+	// expiries are rounded, so a refresh in the same window hands out the same URL
+	assert.Equal(t, variant.String(), variantURL().String())
+
+	// a player still refreshing it one TTL later is turned away until it reloads the master
+	signing.Configure("secret", -time.Minute)
+	assert.ErrorIs(t, verify(variantURL()), signing.ErrExpired)
+}
+
+func TestSegmentURLsSignTheirPlaylistID(t *testing.T) {
+	media := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\nseg-1.ts\n"
+	input := &model.Input{Url: "https://origin.example/live/signed-media.m3u8", Encoded: "signed-media-test"}
+	location, err := url.Parse(input.Url)
+	require.NoError(t, err)
+	signing.Configure("secret", time.Hour)
+	defer signing.Configure("", 0)
+
+	out, err := ModifyM3u8(context.Background(), media, location, NewPrefetcher(1, time.Minute, time.Minute), input, "proxy.example")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	segment, err := url.Parse(lines[len(lines)-1])
+	require.NoError(t, err)
+	_, token, err := parsing.ParseProxyPath(strings.TrimPrefix(segment.Path, "/"))
+	require.NoError(t, err)
+
+	query := segment.Query()
+	assert.NotEmpty(t, query.Get("pId"))
+	require.NoError(t, signing.Verify(token, query))
+
+	// another playlist ID would start a new manifest history for the same segment
+	query.Set("pId", "elsewhere")
+	assert.ErrorIs(t, signing.Verify(token, query), signing.ErrInvalidSignature)
+}
+
+func TestFetchKeyRejectsErrorsAndOversizedBodies(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/key":
+			w.Write([]byte("0123456789abcdef"))
+		case "/huge":
+			w.Write(make([]byte, maxKeyBytes+1))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	t.Cleanup(func() { upstream.Use(&upstream.Policy{}) })
+
+	input := &model.Input{Url: origin.URL + "/index.m3u8"}
+	key, err := fetchKey(context.Background(), origin.URL+"/key", input)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), key)
+
+	// an error page must never be used as the decryption key
+	_, err = fetchKey(context.Background(), origin.URL+"/missing", input)
+	assert.ErrorContains(t, err, "404")
+
+	_, err = fetchKey(context.Background(), origin.URL+"/huge", input)
+	assert.Error(t, err)
+}
@@ -0,0 +1,250 @@
+package hls
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Variant describes a single #EXT-X-STREAM-INF entry of a master playlist.
+type Variant struct {
+	Bandwidth int
+	Width     int
+	Height    int
+	URL       string
+}
+
+// MediaSegment describes a single segment entry of a media playlist.
+type MediaSegment struct {
+	Sequence int
+	Duration time.Duration
+	Tags     []string
+	Key      string
+	URL      string
+}
+
+// MediaPlaylist is the parsed form of a media playlist used by background fetchers.
+type MediaPlaylist struct {
+	TargetDuration time.Duration
+	MediaSequence  int
+	EndList        bool
+	MapURL         string
+	Segments       []MediaSegment
+}
+
+// IsMasterPlaylist reports whether the playlist lists variant streams instead of segments.
+func IsMasterPlaylist(m3u8 string) bool {
+	return strings.Contains(m3u8, "#EXT-X-STREAM-INF")
+}
+
+// ParseVariants extracts the variant streams of a master playlist, resolving relative URIs against parentUrl.
+func ParseVariants(m3u8 string, parentUrl string) []Variant {
+	var variants []Variant
+	var pending *Variant
+	for line := range strings.SplitSeq(strings.TrimRight(m3u8, "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF") {
+			pending = &Variant{}
+			_, attrs, _ := strings.Cut(line, ":")
+			for key, value := range parseAttributes(attrs) {
+				switch key {
+				case "BANDWIDTH":
+					pending.Bandwidth, _ = strconv.Atoi(value)
+				case "RESOLUTION":
+					w, h, _ := strings.Cut(value, "x")
+					pending.Width, _ = strconv.Atoi(w)
+					pending.Height, _ = strconv.Atoi(h)
+				}
+			}
+			continue
+		}
+		if line[0] == '#' || pending == nil {
+			continue
+		}
+		pending.URL = resolveURL(parentUrl, line)
+		variants = append(variants, *pending)
+		pending = nil
+	}
+	return variants
+}
+
+// SelectVariant picks a variant according to the requested choice:
+// "best" (or empty) for the highest bandwidth, "worst" for the lowest,
+// "<height>p" for the tallest variant not exceeding that height, or an exact bandwidth.
+func SelectVariant(variants []Variant, choice string) (Variant, bool) {
+	if len(variants) == 0 {
+		return Variant{}, false
+	}
+
+	sorted := append([]Variant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Bandwidth < sorted[j].Bandwidth
+	})
+
+	choice = strings.ToLower(strings.TrimSpace(choice))
+	switch {
+	case choice == "" || choice == "best":
+		return sorted[len(sorted)-1], true
+	case choice == "worst":
+		return sorted[0], true
+	case strings.HasSuffix(choice, "p"):
+		height, err := strconv.Atoi(strings.TrimSuffix(choice, "p"))
+		if err != nil {
+			return Variant{}, false
+		}
+		var match Variant
+		found := false
+		for _, v := range sorted {
+			if v.Height > 0 && v.Height <= height && (!found || v.Height >= match.Height) {
+				match = v
+				found = true
+			}
+		}
+		if !found {
+			return sorted[0], true
+		}
+		return match, true
+	default:
+		bandwidth, err := strconv.Atoi(choice)
+		if err != nil {
+			return Variant{}, false
+		}
+		for _, v := range sorted {
+			if v.Bandwidth == bandwidth {
+				return v, true
+			}
+		}
+		return Variant{}, false
+	}
+}
+
+// ParseMediaPlaylist extracts target duration, sequence numbers and segment URLs from a media playlist.
+func ParseMediaPlaylist(m3u8 string, parentUrl string) MediaPlaylist {
+	var playlist MediaPlaylist
+	var tags []string
+	var key string
+	var duration time.Duration
+	sequence := 0
+	for line := range strings.SplitSeq(strings.TrimRight(m3u8, "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			switch {
+			case strings.HasPrefix(line, "#EXT-X-TARGETDURATION"):
+				playlist.TargetDuration = parseSeconds(line)
+			case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE"):
+				_, value, _ := strings.Cut(line, ":")
+				sequence, _ = strconv.Atoi(strings.TrimSpace(value))
+				playlist.MediaSequence = sequence
+			case strings.HasPrefix(line, "#EXT-X-ENDLIST"):
+				playlist.EndList = true
+			case strings.HasPrefix(line, "#EXT-X-MAP"):
+				if uri := matchURI(line); uri != "" {
+					playlist.MapURL = resolveURL(parentUrl, uri)
+				}
+			case strings.HasPrefix(line, "#EXT-X-KEY"):
+				key = line
+				if uri := matchURI(line); uri != "" {
+					key = strings.Replace(line, uri, resolveURL(parentUrl, uri), 1)
+				}
+			case strings.HasPrefix(line, "#EXTINF"):
+				duration = parseSeconds(line)
+				tags = append(tags, line)
+			case isPlaylistHeader(line):
+			default:
+				tags = append(tags, line)
+			}
+			continue
+		}
+
+		playlist.Segments = append(playlist.Segments, MediaSegment{
+			Sequence: sequence,
+			Duration: duration,
+			Tags:     tags,
+			Key:      key,
+			URL:      resolveURL(parentUrl, line),
+		})
+		sequence++
+		tags = nil
+		duration = 0
+	}
+	return playlist
+}
+
+// ParseTargetDuration returns the #EXT-X-TARGETDURATION of a media playlist, or zero if absent.
+func ParseTargetDuration(m3u8 string) time.Duration {
+	for line := range strings.SplitSeq(m3u8, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#EXT-X-TARGETDURATION") {
+			return parseSeconds(line)
+		}
+	}
+	return 0
+}
+
+func parseSeconds(line string) time.Duration {
+	_, value, found := strings.Cut(line, ":")
+	if !found {
+		return 0
+	}
+	value, _, _ = strings.Cut(value, ",")
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func parseAttributes(attrs string) map[string]string {
+	out := make(map[string]string)
+	inQuotes := false
+	start := 0
+	for i := 0; i <= len(attrs); i++ {
+		if i < len(attrs) {
+			if attrs[i] == '"' {
+				inQuotes = !inQuotes
+			}
+			if attrs[i] != ',' || inQuotes {
+				continue
+			}
+		}
+		key, value, found := strings.Cut(attrs[start:i], "=")
+		if found {
+			out[strings.ToUpper(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+		start = i + 1
+	}
+	return out
+}
+
+func matchURI(line string) string {
+	match := re.FindStringSubmatch(line)
+	if len(match) < 2 {
+		return ""
+	}
+	return match[1]
+}
+
+func resolveURL(parentUrl, uri string) string {
+	if isAbsoluteURL(uri) {
+		return uri
+	}
+	return joinURL(parentUrl, uri)
+}
+
+// ParentURL returns the directory of a playlist URL, as used to resolve relative entries.
+func ParentURL(u *url.URL) string {
+	parent := *u
+	parent.Path = path.Dir(u.Path)
+	parent.RawQuery = ""
+	parent.Fragment = ""
+	return strings.TrimSuffix(parent.String(), "/")
+}
@@ -0,0 +1,64 @@
+package hls
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAndSelectVariants(t *testing.T) {
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.4d401e,mp4a.40.2\"\n" +
+		"360p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\n" +
+		"https://cdn.example/1080p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720\n" +
+		"720p/index.m3u8\n"
+
+	variants := ParseVariants(master, "https://origin.example/live")
+	require.Len(t, variants, 3)
+	assert.Equal(t, Variant{Bandwidth: 800000, Width: 640, Height: 360, URL: "https://origin.example/live/360p/index.m3u8"}, variants[0])
+	assert.Equal(t, "https://cdn.example/1080p.m3u8", variants[1].URL)
+
+	cases := map[string]int{"": 1080, "best": 1080, "worst": 360, "720p": 720, "900p": 720, "100p": 360, "2500000": 720}
+	for choice, height := range cases {
+		variant, ok := SelectVariant(variants, choice)
+		require.True(t, ok, choice)
+		assert.Equal(t, height, variant.Height, choice)
+	}
+	_, ok := SelectVariant(variants, "123")
+	assert.False(t, ok)
+	_, ok = SelectVariant(nil, "best")
+	assert.False(t, ok)
+}
+
+func TestParseMediaPlaylist(t *testing.T) {
+	media := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:41\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n" +
+		"#EXTINF:5.5,\nseg-41.m4s\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:6.0,\nhttps://cdn.example/seg-42.m4s\n" +
+		"#EXT-X-ENDLIST\n"
+
+	playlist := ParseMediaPlaylist(media, "https://origin.example/live")
+	assert.Equal(t, 6*time.Second, playlist.TargetDuration)
+	assert.Equal(t, 41, playlist.MediaSequence)
+	assert.True(t, playlist.EndList)
+	assert.Equal(t, "https://origin.example/live/init.mp4", playlist.MapURL)
+	require.Len(t, playlist.Segments, 2)
+
+	first := playlist.Segments[0]
+	assert.Equal(t, 41, first.Sequence)
+	assert.Equal(t, 5500*time.Millisecond, first.Duration)
+	assert.Equal(t, "https://origin.example/live/seg-41.m4s", first.URL)
+	assert.Equal(t, "#EXT-X-KEY:METHOD=AES-128,URI=\"https://origin.example/live/key.bin\"", first.Key)
+	assert.Equal(t, []string{"#EXTINF:5.5,"}, first.Tags)
+
+	second := playlist.Segments[1]
+	assert.Equal(t, 42, second.Sequence)
+	assert.Equal(t, "https://cdn.example/seg-42.m4s", second.URL)
+	assert.Equal(t, first.Key, second.Key)
+	assert.Equal(t, []string{"#EXT-X-DISCONTINUITY", "#EXTINF:6.0,"}, second.Tags)
+}
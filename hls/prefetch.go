@@ -1,6 +1,7 @@
 package hls
 
 import (
+	"context"
 	"errors"
 	"math"
 	"net/http"
@@ -8,9 +9,13 @@ import (
 	"time"
 
 	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/metrics"
 	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/tracing"
+	"github.com/bariiss/hls-proxy/upstream"
 	mapset "github.com/deckarep/golang-set/v2"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Interface for structures that can be cleaned by a janitor
@@ -61,25 +66,30 @@ func runJanitor(c Cleanable, ci time.Duration) {
 type PrefetchPlaylist struct {
 	clipRetention time.Duration
 	playlistId    string
+	input         model.Input // header context of the stream, sent with every prefetch
 	playlistClips []string
 	clipToIndex   *concurrentMap[string, int]
 	fetchedClips  *concurrentMap[string, CacheItem[[]byte]]
 }
 
-func newPrefetchPlaylist(playlistId string, playlistClips []string, clipRetention time.Duration) *PrefetchPlaylist {
+func newPrefetchPlaylist(playlistId string, playlistClips []string, input *model.Input, clipRetention time.Duration) *PrefetchPlaylist {
 	clipToIndex := newConcurrentMap[string, int]()
 	fetchedClips := newConcurrentMap[string, CacheItem[[]byte]]()
 
 	for index, clip := range playlistClips {
 		clipToIndex.Set(clip, index)
 	}
-	return &PrefetchPlaylist{
+	playlist := &PrefetchPlaylist{
 		playlistId:    playlistId,
 		playlistClips: playlistClips,
 		clipToIndex:   clipToIndex,
 		fetchedClips:  fetchedClips,
 		clipRetention: clipRetention,
 	}
+	if input != nil {
+		playlist.input = *input
+	}
+	return playlist
 }
 
 func initJanitor(cache Cleanable, ci time.Duration) {
@@ -128,21 +138,13 @@ func (m PrefetchPlaylist) getNextPrefetchClips(clipUrl string, count int) []stri
 	return m.playlistClips[start:end]
 }
 
-func (m PrefetchPlaylist) addClip(clipUrl string, data []byte) error {
+func (m PrefetchPlaylist) addClip(clipUrl string, data []byte) {
 	now := time.Now()
 	expires := now.Add(m.clipRetention)
 	m.fetchedClips.Set(clipUrl, CacheItem[[]byte]{
 		Data:       data,
 		Expiration: expires,
 	})
-
-	if err := SaveSegment(m.playlistId, clipUrl, data); err != nil {
-		log.Warn("Failed to persist segment ", clipUrl, ": ", err)
-		return err
-	}
-
-	SaveSegmentCache(m.playlistId, clipUrl, data)
-	return nil
 }
 
 /*
@@ -181,10 +183,12 @@ func (p Prefetcher) GetFetchedClip(playlistId string, clipUrl string) ([]byte, b
 	return data.Data, ok
 }
 
-func (p Prefetcher) AddPlaylistToCache(playlistId string, clipUrls []string) {
+// AddPlaylistToCache records the clips of a playlist along with the input it was requested
+// with, whose headers later prefetches of those clips carry.
+func (p Prefetcher) AddPlaylistToCache(playlistId string, clipUrls []string, input *model.Input) {
 	log.Debug("Adding playlist to cache ", playlistId)
 	expires := time.Now().Add(p.playlistRetention)
-	newPlaylist := newPrefetchPlaylist(playlistId, clipUrls, p.clipRetention)
+	newPlaylist := newPrefetchPlaylist(playlistId, clipUrls, input, p.clipRetention)
 
 	existingItem, ok := p.playlistInfo.Get(playlistId)
 	if ok {
@@ -237,6 +241,19 @@ func (p *Prefetcher) WarmPlaylist(playlistId string) {
 	go p.queueClipsForPrefetch(playlist, clips)
 }
 
+// QueueClips schedules the given clips of a cached playlist for prefetching.
+func (p *Prefetcher) QueueClips(playlistId string, clips []string) {
+	if p == nil || playlistId == "" || len(clips) == 0 {
+		return
+	}
+
+	playlistItem, ok := p.playlistInfo.Get(playlistId)
+	if !ok || playlistItem.Data == nil {
+		return
+	}
+	go p.queueClipsForPrefetch(playlistItem.Data, clips)
+}
+
 func (p *Prefetcher) queueClipsForPrefetch(playlist *PrefetchPlaylist, clips []string) {
 	if p == nil || playlist == nil || len(clips) == 0 {
 		return
@@ -269,35 +286,52 @@ func (p *Prefetcher) queueClipsForPrefetch(playlist *PrefetchPlaylist, clips []s
 		p.currentlyPrefetching.Add(clip)
 		go func(clip string) {
 			defer p.currentlyPrefetching.Remove(clip)
-
-			data, err := fetchClip(clip)
+			ctx, span := tracing.Start(context.Background(), "prefetch clip",
+				tracing.FullURL(clip), attribute.String("playlist.id", playlist.playlistId))
+			defer span.End()
+
+			segment, fetched, err := FetchSegmentOnce(playlist.playlistId, clip, func() (FetchedSegment, error) {
+				data, err := fetchClip(ctx, clip, &playlist.input)
+				return FetchedSegment{Data: data}, err
+			})
+			span.SetAttributes(attribute.Bool("segment.joined_fetch", !fetched))
 			if err != nil {
+				tracing.Fail(span, err)
+				metrics.PrefetchClips.WithLabelValues("failed").Inc()
 				log.Debug("Error fetching clip ", clip, err)
 				return
 			}
-			log.Debug("Fetched clip ", clip)
-
-			if err := playlist.addClip(clip, data); err != nil {
-				log.Debug("Failed to cache clip ", clip, err)
-				return
+			if fetched {
+				metrics.PrefetchClips.WithLabelValues("fetched").Inc()
+				log.Debug("Fetched clip ", clip)
+			} else {
+				metrics.PrefetchClips.WithLabelValues("joined").Inc()
+				log.Debug("Joined in-flight fetch for clip ", clip)
 			}
 
-			RecordSegmentRequest(playlist.playlistId)
+			playlist.addClip(clip, segment.Data)
+
+			recordPrefetchedSegment(playlist.playlistId)
 			log.Debug("Number of cached clips", playlist.fetchedClips.Count())
 		}(clip)
 	}
 }
 
-func fetchClip(clipUrl string) ([]byte, error) {
+func fetchClip(ctx context.Context, clipUrl string, input *model.Input) ([]byte, error) {
 	if clipUrl == "" {
 		return nil, errors.New("clip URL is empty")
 	}
+	if err := upstream.CheckURL(clipUrl); err != nil {
+		log.Warn("Blocked prefetch: ", err)
+		return nil, err
+	}
 
-	request, err := http.NewRequest("GET", clipUrl, nil)
+	request, err := http.NewRequestWithContext(upstream.WithProxy(ctx, input.Proxy), "GET", clipUrl, nil)
 	if err != nil {
 		log.Error("Error creating request ", clipUrl, err)
 		return nil, err
 	}
+	http_retry.SetBaseHeaders(request, input)
 
 	resp, err := http_retry.ExecuteRetryClipRequest(request, model.Configuration.Attempts)
 	if err != nil {
@@ -328,6 +362,7 @@ func (p *Prefetcher) getJanitor() *Janitor {
 
 func (p *Prefetcher) Clean() {
 	log.Debug("Cleaning playlist cache")
+	metrics.JanitorRuns.WithLabelValues("prefetch").Inc()
 	currentTime := time.Now()
 	for playlistId, playlistItem := range p.playlistInfo.Items() {
 		if playlistItem.Expiration.Before(currentTime) {
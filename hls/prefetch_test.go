@@ -0,0 +1,52 @@
+package hls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchSendsStreamHeaders(t *testing.T) {
+	var rejected atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a hotlink-protected origin
+		cookie, _ := r.Cookie("session")
+		if r.Referer() != "https://player.example" || r.Header.Get("X-Token") != "t" || cookie == nil || cookie.Value != "abc" {
+			rejected.Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("segment"))
+	}))
+	defer origin.Close()
+	// the origin listens on loopback, which the default upstream policy refuses
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	t.Cleanup(func() { upstream.Use(&upstream.Policy{}) })
+	model.Configuration.Attempts = 1
+
+	clip := origin.URL + "/1.ts"
+	input := &model.Input{
+		Url:     origin.URL + "/index.m3u8",
+		Referer: "https://player.example",
+		Headers: map[string]string{"X-Token": "t"},
+		Cookies: map[string]string{"session": "abc"},
+	}
+	prefetcher := NewPrefetcher(1, time.Minute, time.Minute)
+	prefetcher.AddPlaylistToCache("playlist", []string{clip}, input)
+	prefetcher.QueueClips("playlist", []string{clip})
+
+	require.Eventually(t, func() bool {
+		_, ok := prefetcher.GetFetchedClip("playlist", clip)
+		return ok
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Zero(t, rejected.Load())
+}
@@ -0,0 +1,120 @@
+package hls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blobDirName holds segment bytes named by their sha256, shared by every manifest whose
+// index refers to them. The leading dot keeps it apart from sanitized manifest IDs.
+const blobDirName = ".blobs"
+
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *fileSegmentStore) blobRoot() string {
+	return filepath.Join(s.baseDir, blobDirName)
+}
+
+func (s *fileSegmentStore) blobPath(blob string) string {
+	return filepath.Join(s.blobRoot(), blob[:2], blob[2:]+".blob")
+}
+
+// retainBlobLocked takes a reference on the blob holding data, writing it to disk when no
+// manifest referred to it yet. Only new blobs count against the free-space floor.
+func (s *fileSegmentStore) retainBlobLocked(blob string, data []byte) error {
+	if s.refs[blob] > 0 {
+		s.refs[blob]++
+		return nil
+	}
+
+	if err := s.checkFreeSpaceLocked(int64(len(data))); err != nil {
+		return err
+	}
+	path := s.blobPath(blob)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create segment path: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("write segment blob: %w", err)
+	}
+	s.refs[blob] = 1
+	s.totalBytes += int64(len(data))
+	return nil
+}
+
+// releaseBlobLocked drops a reference and deletes the blob once nothing refers to it.
+func (s *fileSegmentStore) releaseBlobLocked(blob string, size int64) {
+	if blob == "" {
+		return
+	}
+	s.refs[blob]--
+	if s.refs[blob] > 0 {
+		return
+	}
+	delete(s.refs, blob)
+	s.totalBytes -= size
+
+	path := s.blobPath(blob)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("failed to remove segment blob %s: %v", path, err)
+		return
+	}
+	cleanupEmptyDirs(filepath.Dir(path), s.blobRoot())
+}
+
+// locate returns the blob file for a stored segment and marks the segment as just served.
+func (s *fileSegmentStore) locate(manifestID, key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index, ok := s.indexes[manifestID]
+	if !ok {
+		return "", false
+	}
+	record, ok := index.Segments[key]
+	if !ok || record.Blob == "" {
+		return "", false
+	}
+	s.touchLocked(index, record)
+	return s.blobPath(record.Blob), true
+}
+
+// adoptLegacyFile moves a segment stored before blobs existed, at a per-manifest path,
+// into the blob directory and returns its hash.
+func (s *fileSegmentStore) adoptLegacyFile(manifestID string, record *segmentRecord) (string, bool) {
+	data, err := os.ReadFile(s.legacyPathFor(manifestID, record.URL))
+	if err != nil {
+		return "", false
+	}
+	blob := blobHash(data)
+	if s.refs[blob] == 0 {
+		path := s.blobPath(blob)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", false
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return "", false
+		}
+	}
+	record.Size = int64(len(data))
+	return blob, true
+}
+
+// removeOrphanBlobs deletes blobs no manifest index refers to, such as ones whose last
+// reference was dropped while the process was being killed.
+func (s *fileSegmentStore) removeOrphanBlobs() {
+	known := make(map[string]struct{}, len(s.refs))
+	for blob := range s.refs {
+		known[s.blobPath(blob)] = struct{}{}
+	}
+	removeUnindexedFiles(s.blobRoot(), known)
+}
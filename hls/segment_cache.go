@@ -1,10 +1,36 @@
 package hls
 
-import "sync"
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats summarises the in-memory segment cache.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Manifests int    `json:"manifests"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// Occupancy is how many segments and bytes a manifest holds in a cache or store.
+type Occupancy struct {
+	Segments int   `json:"segments"`
+	Bytes    int64 `json:"bytes"`
+}
+
+type cacheEntry struct {
+	manifestID string
+	key        string
+	data       []byte
+}
 
 type manifestCache struct {
-	order   []string
-	entries map[string][]byte
+	entries map[string]*list.Element
+	bytes   int64
 }
 
 type segmentCacheStore interface {
@@ -12,26 +38,41 @@ type segmentCacheStore interface {
 	Load(manifestID, key string) ([]byte, bool)
 	Remove(manifestID string)
 	Reset()
+	Stats() CacheStats
+	Usage() map[string]Occupancy
 }
 
 type noopSegmentCache struct{}
 
+// memorySegmentCache is an LRU over every cached segment with a global byte budget.
+// When the budget is exceeded, manifests holding more than their fair share of the budget
+// are evicted from first, so one busy channel cannot push every other channel out.
 type memorySegmentCache struct {
-	mu        sync.RWMutex
-	limit     int
+	mu        sync.Mutex
+	maxBytes  int64
+	bytes     int64
+	lru       *list.List
 	manifests map[string]*manifestCache
+	hits      uint64
+	misses    uint64
+	evictions uint64
 }
 
 func (noopSegmentCache) Save(string, string, []byte) {}
 func (noopSegmentCache) Load(string, string) ([]byte, bool) {
 	return nil, false
 }
-func (noopSegmentCache) Remove(string) {}
-func (noopSegmentCache) Reset()        {}
+func (noopSegmentCache) Remove(string)     {}
+func (noopSegmentCache) Reset()            {}
+func (noopSegmentCache) Stats() CacheStats { return CacheStats{} }
+func (noopSegmentCache) Usage() map[string]Occupancy {
+	return nil
+}
 
-func newMemorySegmentCache(limit int) *memorySegmentCache {
+func newMemorySegmentCache(maxBytes int64) *memorySegmentCache {
 	return &memorySegmentCache{
-		limit:     limit,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
 		manifests: make(map[string]*manifestCache),
 	}
 }
@@ -40,13 +81,36 @@ func (c *memorySegmentCache) Save(manifestID, key string, data []byte) {
 	if len(data) == 0 || manifestID == "" || key == "" {
 		return
 	}
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		return
+	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	manifest := c.ensureManifest(manifestID)
-	manifest.set(key, data)
-	manifest.evict(c.limit)
+	if elem, ok := manifest.entries[key]; ok {
+		// replaced in place, since removing it could drop the manifest it belongs to
+		entry := elem.Value.(*cacheEntry)
+		delta := int64(len(data)) - int64(len(entry.data))
+		entry.data = append([]byte(nil), data...)
+		manifest.bytes += delta
+		c.bytes += delta
+		c.lru.MoveToFront(elem)
+		c.evictLocked()
+		return
+	}
+
+	entry := &cacheEntry{
+		manifestID: manifestID,
+		key:        key,
+		data:       append([]byte(nil), data...),
+	}
+	manifest.entries[key] = c.lru.PushFront(entry)
+	manifest.bytes += int64(len(data))
+	c.bytes += int64(len(data))
+
+	c.evictLocked()
 }
 
 func (c *memorySegmentCache) Load(manifestID, key string) ([]byte, bool) {
@@ -54,18 +118,22 @@ func (c *memorySegmentCache) Load(manifestID, key string) ([]byte, bool) {
 		return nil, false
 	}
 
-	c.mu.RLock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	manifest, ok := c.manifests[manifestID]
 	if !ok {
-		c.mu.RUnlock()
+		c.misses++
 		return nil, false
 	}
-	data, ok := manifest.entries[key]
-	c.mu.RUnlock()
+	elem, ok := manifest.entries[key]
 	if !ok {
+		c.misses++
 		return nil, false
 	}
-	copy := append([]byte(nil), data...)
+	c.hits++
+	c.lru.MoveToFront(elem)
+	copy := append([]byte(nil), elem.Value.(*cacheEntry).data...)
 	return copy, true
 }
 
@@ -76,6 +144,13 @@ func (c *memorySegmentCache) Remove(manifestID string) {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	manifest, ok := c.manifests[manifestID]
+	if !ok {
+		return
+	}
+	for _, elem := range manifest.entries {
+		c.removeElement(elem)
+	}
 	delete(c.manifests, manifestID)
 }
 
@@ -83,6 +158,32 @@ func (c *memorySegmentCache) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.manifests = make(map[string]*manifestCache)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+func (c *memorySegmentCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.lru.Len(),
+		Manifests: len(c.manifests),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+func (c *memorySegmentCache) Usage() map[string]Occupancy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	usage := make(map[string]Occupancy, len(c.manifests))
+	for manifestID, manifest := range c.manifests {
+		usage[manifestID] = Occupancy{Segments: len(manifest.entries), Bytes: manifest.bytes}
+	}
+	return usage
 }
 
 func (c *memorySegmentCache) ensureManifest(manifestID string) *manifestCache {
@@ -90,45 +191,50 @@ func (c *memorySegmentCache) ensureManifest(manifestID string) *manifestCache {
 		return manifest
 	}
 	manifest := &manifestCache{
-		order:   make([]string, 0),
-		entries: make(map[string][]byte),
+		entries: make(map[string]*list.Element),
 	}
 	c.manifests[manifestID] = manifest
 	return manifest
 }
 
-func (m *manifestCache) set(key string, data []byte) {
-	m.remove(key)
-	m.entries[key] = append([]byte(nil), data...)
-	m.order = append(m.order, key)
-}
-
-func (m *manifestCache) evict(limit int) {
-	if limit <= 0 {
+func (c *memorySegmentCache) evictLocked() {
+	if c.maxBytes <= 0 {
 		return
 	}
 
-	for len(m.order) > limit {
-		oldest := m.order[0]
-		m.order = m.order[1:]
-		delete(m.entries, oldest)
+	// one walk from the oldest entry evicts from manifests over their fair share. Shares only
+	// grow as manifests empty out, so an entry passed over never becomes a victim later.
+	for elem := c.lru.Back(); elem != nil && c.bytes > c.maxBytes; {
+		prev := elem.Prev()
+		entry := elem.Value.(*cacheEntry)
+		if c.manifests[entry.manifestID].bytes > c.maxBytes/int64(len(c.manifests)) {
+			c.removeElement(elem)
+			c.evictions++
+		}
+		elem = prev
+	}
+	// with no manifest over its share, the least recently used entries go
+	for c.bytes > c.maxBytes && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+		c.evictions++
 	}
 }
 
-func (m *manifestCache) remove(key string) bool {
-	if _, exists := m.entries[key]; !exists {
-		return false
-	}
+// removeElement unlinks an entry from the LRU and its manifest, dropping empty manifests.
+func (c *memorySegmentCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	c.bytes -= int64(len(entry.data))
 
-	delete(m.entries, key)
-	for i, existing := range m.order {
-		if existing != key {
-			continue
-		}
-		m.order = append(m.order[:i], m.order[i+1:]...)
-		return true
+	manifest, ok := c.manifests[entry.manifestID]
+	if !ok {
+		return
+	}
+	delete(manifest.entries, entry.key)
+	manifest.bytes -= int64(len(entry.data))
+	if len(manifest.entries) == 0 {
+		delete(c.manifests, entry.manifestID)
 	}
-	return false
 }
 
 var (
@@ -138,7 +244,8 @@ var (
 )
 
 // ConfigureSegmentCache switches the in-memory cache implementation on or off.
-func ConfigureSegmentCache(enabled bool, limit int) {
+// maxBytes bounds the total size of cached segments across all manifests; zero means unbounded.
+func ConfigureSegmentCache(enabled bool, maxBytes int64) {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
 
@@ -147,10 +254,14 @@ func ConfigureSegmentCache(enabled bool, limit int) {
 		return
 	}
 
-	if limit < 0 {
-		limit = 0
+	if maxBytes < 0 {
+		maxBytes = 0
 	}
-	setActiveCache(newMemorySegmentCache(limit), true)
+	var store segmentCacheStore = newMemorySegmentCache(maxBytes)
+	if shared := currentSharedCache(); shared != nil {
+		store = shared.over(store)
+	}
+	setActiveCache(store, true)
 }
 
 // SaveSegmentCache stores the provided bytes in the active in-memory cache, if enabled.
@@ -189,6 +300,24 @@ func ResetSegmentCache() {
 	cache.Reset()
 }
 
+// SegmentCacheUsage reports what each manifest holds in this process's memory cache.
+func SegmentCacheUsage() map[string]Occupancy {
+	cache, ok := activeCache()
+	if !ok {
+		return nil
+	}
+	return cache.Usage()
+}
+
+// SegmentCacheStats reports hit, miss and eviction counters along with current occupancy.
+func SegmentCacheStats() CacheStats {
+	cache, ok := activeCache()
+	if !ok {
+		return CacheStats{}
+	}
+	return cache.Stats()
+}
+
 func setActiveCache(store segmentCacheStore, enabled bool) {
 	activeSegmentCache = store
 	segmentCacheEnabled = enabled
@@ -0,0 +1,56 @@
+package hls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySegmentCacheEvictsOverBudget(t *testing.T) {
+	cache := newMemorySegmentCache(10)
+
+	cache.Save("a", "1", []byte("aaaa"))
+	cache.Save("a", "2", []byte("aaaa"))
+	cache.Save("b", "1", []byte("bbbb"))
+
+	// a holds 8 of the 10 bytes, more than its fair share, so its oldest entry goes first
+	_, ok := cache.Load("a", "1")
+	assert.False(t, ok)
+	_, ok = cache.Load("a", "2")
+	assert.True(t, ok)
+	_, ok = cache.Load("b", "1")
+	assert.True(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(8), stats.Bytes)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	cache.Remove("a")
+	stats = cache.Stats()
+	assert.Equal(t, int64(4), stats.Bytes)
+	assert.Equal(t, 1, stats.Manifests)
+}
+
+func TestMemorySegmentCacheResavesTheOnlyEntryOfAManifest(t *testing.T) {
+	cache := newMemorySegmentCache(10)
+
+	cache.Save("a", "1", []byte("aaaa"))
+	cache.Save("a", "1", []byte("aaaaaa"))
+	data, ok := cache.Load("a", "1")
+	assert.True(t, ok)
+	assert.Equal(t, "aaaaaa", string(data))
+	assert.Equal(t, int64(6), cache.Stats().Bytes)
+
+	// going over the budget evicts through the manifest the re-saved entry belongs to
+	cache.Save("b", "1", []byte("bbbbbb"))
+	_, ok = cache.Load("a", "1")
+	assert.False(t, ok)
+	_, ok = cache.Load("b", "1")
+	assert.True(t, ok)
+	stats := cache.Stats()
+	assert.Equal(t, int64(6), stats.Bytes)
+	assert.Equal(t, 1, stats.Manifests)
+	assert.Equal(t, map[string]Occupancy{"b": {Segments: 1, Bytes: 6}}, cache.Usage())
+}
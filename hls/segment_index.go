@@ -0,0 +1,305 @@
+package hls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	indexFileName    = "index.json"
+	playlistFileName = "playlist.m3u8"
+)
+
+// segmentRecord describes a stored segment file in the on-disk index.
+type segmentRecord struct {
+	URL        string    `json:"url"`
+	Sequence   int       `json:"sequence"`
+	Duration   float64   `json:"duration"`
+	Size       int64     `json:"size"`
+	Blob       string    `json:"blob,omitempty"`
+	FetchedAt  time.Time `json:"fetched_at"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// manifestIndex lists the segments stored for one manifest, so a persistent store can be
+// reloaded after a restart and map its sha1-named files back to segment URLs.
+// bytes and lastAccess are kept up to date as segments come and go, so quota eviction never
+// has to walk the directory tree.
+type manifestIndex struct {
+	ManifestID  string
+	PlaylistURL string
+	Complete    bool
+	Segments    map[string]*segmentRecord
+	bytes       int64
+	lastAccess  time.Time
+	dirty       bool
+}
+
+type manifestIndexFile struct {
+	ManifestID  string          `json:"manifest_id"`
+	PlaylistURL string          `json:"playlist_url,omitempty"`
+	Complete    bool            `json:"complete,omitempty"`
+	Segments    []segmentRecord `json:"segments"`
+}
+
+func newManifestIndex(manifestID string) *manifestIndex {
+	return &manifestIndex{
+		ManifestID: manifestID,
+		Segments:   make(map[string]*segmentRecord),
+	}
+}
+
+func (s *fileSegmentStore) indexFor(manifestID string) *manifestIndex {
+	index, ok := s.indexes[manifestID]
+	if !ok {
+		index = newManifestIndex(manifestID)
+		s.indexes[manifestID] = index
+	}
+	return index
+}
+
+func (s *fileSegmentStore) recordLocked(manifestID, key string, size int, blob string) {
+	sequence, duration := segmentMetadata(manifestID, key)
+	index := s.indexFor(manifestID)
+	if previous, ok := index.Segments[key]; ok {
+		index.bytes -= previous.Size
+		s.releaseBlobLocked(previous.Blob, previous.Size)
+	}
+	now := time.Now()
+	index.Segments[key] = &segmentRecord{
+		URL:        key,
+		Sequence:   sequence,
+		Duration:   duration.Seconds(),
+		Size:       int64(size),
+		Blob:       blob,
+		FetchedAt:  now,
+		LastAccess: now,
+	}
+	index.bytes += int64(size)
+	index.lastAccess = now
+	index.dirty = true
+}
+
+func (s *fileSegmentStore) writeIndexLocked(manifestID string) error {
+	index, ok := s.indexes[manifestID]
+	if !ok {
+		return nil
+	}
+	index.dirty = false
+
+	file := manifestIndexFile{
+		ManifestID:  index.ManifestID,
+		PlaylistURL: index.PlaylistURL,
+		Complete:    index.Complete,
+		Segments:    make([]segmentRecord, 0, len(index.Segments)),
+	}
+	for _, record := range index.Segments {
+		file.Segments = append(file.Segments, *record)
+	}
+	sort.Slice(file.Segments, func(i, j int) bool {
+		return file.Segments[i].Sequence < file.Segments[j].Sequence
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode segment index: %w", err)
+	}
+	root := s.manifestRoot(manifestID)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return fmt.Errorf("create segment path: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(root, indexFileName), data)
+}
+
+// loadIndexes rebuilds the in-memory index from the index files left by a previous run,
+// dropping records whose files are gone and files that no record refers to.
+func (s *fileSegmentStore) loadIndexes() error {
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return fmt.Errorf("read segment directory: %w", err)
+	}
+
+	segments := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == blobDirName {
+			continue
+		}
+		root := filepath.Join(s.baseDir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(root, indexFileName))
+		if err != nil {
+			log.Warnf("segment directory %s has no readable index, removing it", root)
+			_ = os.RemoveAll(root)
+			continue
+		}
+
+		var file manifestIndexFile
+		if err := json.Unmarshal(data, &file); err != nil || file.ManifestID == "" {
+			log.Warnf("segment index in %s is corrupt, removing it", root)
+			_ = os.RemoveAll(root)
+			continue
+		}
+		if _, seen := s.indexes[file.ManifestID]; seen {
+			log.Warnf("segment index in %s repeats manifest %s, removing it", root, file.ManifestID)
+			_ = os.RemoveAll(root)
+			continue
+		}
+		// directories named before they carried a hash of the manifest ID move to their new name
+		if want := s.manifestRoot(file.ManifestID); root != want {
+			if err := os.Rename(root, want); err != nil {
+				log.Warnf("move segment directory %s to %s: %v", root, want, err)
+				continue
+			}
+			root = want
+		}
+
+		index := newManifestIndex(file.ManifestID)
+		index.PlaylistURL = file.PlaylistURL
+		index.Complete = file.Complete
+		for _, record := range file.Segments {
+			if record.Blob == "" {
+				blob, ok := s.adoptLegacyFile(file.ManifestID, &record)
+				if !ok {
+					continue
+				}
+				record.Blob = blob
+			} else if s.refs[record.Blob] == 0 {
+				if _, err := os.Stat(s.blobPath(record.Blob)); err != nil {
+					continue
+				}
+			}
+			if s.refs[record.Blob] == 0 {
+				s.totalBytes += record.Size
+			}
+			s.refs[record.Blob]++
+			if record.LastAccess.IsZero() {
+				record.LastAccess = record.FetchedAt
+			}
+			index.Segments[record.URL] = &record
+			index.bytes += record.Size
+			if record.LastAccess.After(index.lastAccess) {
+				index.lastAccess = record.LastAccess
+			}
+		}
+		s.indexes[file.ManifestID] = index
+		segments += len(index.Segments)
+
+		// segment bytes live in blobs, so anything left under the manifest is stale
+		removeUnindexedFiles(root, nil)
+		if err := s.writeIndexLocked(file.ManifestID); err != nil {
+			log.Warnf("rewrite segment index for %s: %v", file.ManifestID, err)
+		}
+	}
+
+	s.removeOrphanBlobs()
+	log.Infof("Loaded %d stored segments (%d bytes in %d blobs) across %d manifests from %s",
+		segments, s.totalBytes, len(s.refs), len(s.indexes), s.baseDir)
+	return nil
+}
+
+func removeUnindexedFiles(root string, known map[string]struct{}) {
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil || info.IsDir() {
+			return nil
+		}
+		if !strings.HasSuffix(path, ".seg") && !strings.HasSuffix(path, ".blob") && !strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		if _, ok := known[path]; ok {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("remove unindexed segment %s: %v", path, err)
+			return nil
+		}
+		cleanupEmptyDirs(filepath.Dir(path), root)
+		return nil
+	})
+}
+
+func (s *fileSegmentStore) SavePlaylist(manifestID, sourceURL string, body []byte) error {
+	if !s.persistent || manifestID == "" || len(body) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root := s.manifestRoot(manifestID)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return fmt.Errorf("create segment path: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(root, playlistFileName), body); err != nil {
+		return err
+	}
+	s.indexFor(manifestID).PlaylistURL = sourceURL
+	return s.writeIndexLocked(manifestID)
+}
+
+func (s *fileSegmentStore) LoadPlaylist(manifestID string) ([]byte, string, bool, error) {
+	if !s.persistent || manifestID == "" {
+		return nil, "", false, nil
+	}
+
+	s.mu.Lock()
+	index, ok := s.indexes[manifestID]
+	var sourceURL string
+	if ok {
+		sourceURL = index.PlaylistURL
+	}
+	s.mu.Unlock()
+	if sourceURL == "" {
+		return nil, "", false, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.manifestRoot(manifestID), playlistFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, fmt.Errorf("read stored playlist: %w", err)
+	}
+	return data, sourceURL, true, nil
+}
+
+// segmentMetadata looks up the sequence number and EXTINF duration the manifest history
+// recorded for a segment, so the index can describe stored files without the playlist.
+func segmentMetadata(manifestID, clipUrl string) (int, time.Duration) {
+	history, ok := histories.Get(manifestID)
+	if !ok || history == nil {
+		return 0, 0
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	segment, ok := history.segments[clipUrl]
+	if !ok {
+		return 0, 0
+	}
+	var duration time.Duration
+	for _, tag := range segment.Tags {
+		if strings.HasPrefix(tag, "#EXTINF") {
+			duration = parseSeconds(tag)
+		}
+	}
+	return segment.Sequence, duration
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("finalize file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/bariiss/hls-proxy/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSegmentStoreFull is returned by Save while the filesystem holding the segment directory
+// has less free space than the configured floor.
+var ErrSegmentStoreFull = errors.New("segment store: free disk space below floor")
+
+// StoreStats summarises the disk segment store.
+type StoreStats struct {
+	Manifests    int    `json:"manifests"`
+	Segments     int    `json:"segments"`
+	Blobs        int    `json:"blobs"`
+	Bytes        int64  `json:"bytes"`
+	MaxBytes     int64  `json:"max_bytes"`
+	MinFreeBytes int64  `json:"min_free_bytes"`
+	Evictions    uint64 `json:"evictions"`
+	Full         bool   `json:"full"`
+}
+
+// touchLocked marks a stored segment and its manifest as just served, which keeps them away
+// from the front of the eviction order.
+func (s *fileSegmentStore) touchLocked(index *manifestIndex, record *segmentRecord) {
+	now := time.Now()
+	record.LastAccess = now
+	index.lastAccess = now
+	index.dirty = true
+}
+
+// removeRecordLocked drops one segment from a manifest's index, deleting its blob when no
+// other manifest refers to the same bytes.
+func (s *fileSegmentStore) removeRecordLocked(index *manifestIndex, record *segmentRecord) {
+	delete(index.Segments, record.URL)
+	index.bytes -= record.Size
+	index.dirty = true
+	s.releaseBlobLocked(record.Blob, record.Size)
+}
+
+// enforceQuotaLocked evicts segments until the store fits its byte quota. The manifest that
+// was served least recently gives up its least recently served segments first; bytes only
+// come back once every manifest sharing a blob has let go of it.
+func (s *fileSegmentStore) enforceQuotaLocked() {
+	if s.maxBytes <= 0 {
+		return
+	}
+
+	for s.totalBytes > s.maxBytes {
+		victim := s.oldestManifestLocked()
+		if victim == nil {
+			return
+		}
+
+		records := make([]*segmentRecord, 0, len(victim.Segments))
+		for _, record := range victim.Segments {
+			records = append(records, record)
+		}
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].LastAccess.Before(records[j].LastAccess)
+		})
+
+		before := len(victim.Segments)
+		for _, record := range records {
+			if s.totalBytes <= s.maxBytes {
+				break
+			}
+			s.removeRecordLocked(victim, record)
+			s.evictions++
+		}
+		if len(victim.Segments) == 0 {
+			s.dropEmptyManifestLocked(victim)
+		}
+		if len(victim.Segments) == before {
+			return
+		}
+	}
+}
+
+func (s *fileSegmentStore) oldestManifestLocked() *manifestIndex {
+	var oldest *manifestIndex
+	for _, index := range s.indexes {
+		if len(index.Segments) == 0 {
+			continue
+		}
+		if oldest == nil || index.lastAccess.Before(oldest.lastAccess) {
+			oldest = index
+		}
+	}
+	return oldest
+}
+
+// dropEmptyManifestLocked forgets a manifest whose segments were all evicted. Manifests with
+// a saved playlist keep their directory so the playlist can still be replayed.
+func (s *fileSegmentStore) dropEmptyManifestLocked(index *manifestIndex) {
+	if index.PlaylistURL != "" {
+		return
+	}
+	delete(s.indexes, index.ManifestID)
+	if err := os.RemoveAll(s.manifestRoot(index.ManifestID)); err != nil {
+		log.Warnf("failed to remove empty manifest directory for %s: %v", index.ManifestID, err)
+	}
+}
+
+// checkFreeSpaceLocked refuses a write of size bytes that would leave the filesystem below
+// the free-space floor, logging once each time the store fills up or recovers.
+func (s *fileSegmentStore) checkFreeSpaceLocked(size int64) error {
+	if s.minFreeBytes <= 0 {
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.baseDir, &stat); err != nil {
+		return fmt.Errorf("stat segment directory: %w", err)
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+
+	if free-size < s.minFreeBytes {
+		if !s.full {
+			log.Warnf("Segment store paused: %d bytes free on %s, floor is %d", free, s.baseDir, s.minFreeBytes)
+		}
+		s.full = true
+		return ErrSegmentStoreFull
+	}
+	if s.full {
+		log.Infof("Segment store resumed: %d bytes free on %s", free, s.baseDir)
+	}
+	s.full = false
+	return nil
+}
+
+// startCompactor periodically re-applies the quota and, for persistent stores, flushes the
+// access times that Load only updates in memory.
+func (s *fileSegmentStore) startCompactor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.compact()
+			case <-stop:
+				return
+			}
+		}
+	}(s.stop)
+}
+
+func (s *fileSegmentStore) stopCompactor() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *fileSegmentStore) compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics.JanitorRuns.WithLabelValues("store").Inc()
+
+	s.enforceQuotaLocked()
+	if !s.persistent {
+		return
+	}
+	for manifestID, index := range s.indexes {
+		if !index.dirty {
+			continue
+		}
+		if err := s.writeIndexLocked(manifestID); err != nil {
+			log.Warnf("flush segment index for %s: %v", manifestID, err)
+		}
+	}
+}
+
+func (s *fileSegmentStore) stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := StoreStats{
+		Manifests:    len(s.indexes),
+		Blobs:        len(s.refs),
+		Bytes:        s.totalBytes,
+		MaxBytes:     s.maxBytes,
+		MinFreeBytes: s.minFreeBytes,
+		Evictions:    s.evictions,
+		Full:         s.full,
+	}
+	for _, index := range s.indexes {
+		stats.Segments += len(index.Segments)
+	}
+	return stats
+}
+
+func (s *fileSegmentStore) usage() map[string]Occupancy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := make(map[string]Occupancy, len(s.indexes))
+	for manifestID, index := range s.indexes {
+		usage[manifestID] = Occupancy{Segments: len(index.Segments), Bytes: index.bytes}
+	}
+	return usage
+}
+
+// SegmentStoreUsage reports what each manifest holds in the disk store. Bytes shared with
+// other manifests are counted for each of them.
+func SegmentStoreUsage() map[string]Occupancy {
+	storeMu.RLock()
+	store := activeStore
+	storeMu.RUnlock()
+	fs, ok := store.(*fileSegmentStore)
+	if !ok {
+		return nil
+	}
+	return fs.usage()
+}
+
+// SegmentStoreStats reports occupancy of the disk segment store, if one is active.
+func SegmentStoreStats() StoreStats {
+	storeMu.RLock()
+	store := activeStore
+	storeMu.RUnlock()
+	fs, ok := store.(*fileSegmentStore)
+	if !ok {
+		return StoreStats{}
+	}
+	return fs.stats()
+}
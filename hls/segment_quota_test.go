@@ -0,0 +1,132 @@
+package hls
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSegmentStoreEvictsLeastRecentlyWatchedManifest(t *testing.T) {
+	store, err := newFileSegmentStore(t.TempDir(), 0, false)
+	require.NoError(t, err)
+	store.maxBytes = 10
+
+	require.NoError(t, store.Save("a", "1", []byte("aaa1")))
+	require.NoError(t, store.Save("b", "1", []byte("bbbb")))
+	_, ok, _ := store.Load(context.Background(), "a", "1")
+	assert.True(t, ok)
+
+	// b was served longest ago, so it makes room for the new segment of a
+	require.NoError(t, store.Save("a", "2", []byte("aaa2")))
+	_, ok, _ = store.Load(context.Background(), "b", "1")
+	assert.False(t, ok)
+	_, ok, _ = store.Load(context.Background(), "a", "1")
+	assert.True(t, ok)
+
+	stats := store.stats()
+	assert.Equal(t, int64(8), stats.Bytes)
+	assert.Equal(t, 1, stats.Manifests)
+	assert.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestFileSegmentStoreSharesIdenticalSegments(t *testing.T) {
+	store, err := newFileSegmentStore(t.TempDir(), 0, false)
+	require.NoError(t, err)
+
+	// the same segment reached through two manifests, e.g. with different Referer variants
+	require.NoError(t, store.Save("a", "http://origin/1.ts", []byte("segment")))
+	require.NoError(t, store.Save("b", "http://origin/1.ts", []byte("segment")))
+	stats := store.stats()
+	assert.Equal(t, 1, stats.Blobs)
+	assert.Equal(t, int64(7), stats.Bytes)
+
+	require.NoError(t, store.Remove("a"))
+	data, ok, err := store.Load(context.Background(), "b", "http://origin/1.ts")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("segment"), data)
+
+	require.NoError(t, store.Remove("b"))
+	stats = store.stats()
+	assert.Equal(t, 0, stats.Blobs)
+	assert.Equal(t, int64(0), stats.Bytes)
+}
+
+func TestPersistentFileSegmentStoreKeepsAWindowUntilThePlaylistEnds(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileSegmentStore(dir, 2, true)
+	require.NoError(t, err)
+
+	// a live playlist keeps the rolling window even though the store persists
+	for _, key := range []string{"1", "2", "3"} {
+		require.NoError(t, store.Save("live", key, []byte("live"+key)))
+	}
+	assert.Len(t, store.indexes["live"].Segments, 2)
+
+	store.markComplete("vod")
+	for _, key := range []string{"1", "2", "3"} {
+		require.NoError(t, store.Save("vod", key, []byte("vod"+key)))
+	}
+	assert.Len(t, store.indexes["vod"].Segments, 3)
+
+	// completeness survives a restart
+	reloaded, err := newFileSegmentStore(dir, 2, true)
+	require.NoError(t, err)
+	assert.True(t, reloaded.indexes["vod"].Complete)
+	assert.False(t, reloaded.indexes["live"].Complete)
+}
+
+func TestFileSegmentStoreKeepsManifestsWithALongSharedPrefixApart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileSegmentStore(dir, 0, true)
+	require.NoError(t, err)
+
+	// base64 keys of two variants of one stream only differ past the first 120 characters
+	prefix := strings.Repeat("aHR0cHM6Ly9kMTIzNC5jbG91ZGZyb250Lm5ldC9vdXQvdjEv", 4)
+	hd, sd := prefix+"aW5kZXhfMTA4MHA", prefix+"aW5kZXhfNzIwcA"
+	require.NotEqual(t, store.manifestRoot(hd), store.manifestRoot(sd))
+
+	require.NoError(t, store.Save(hd, "1", []byte("hd")))
+	require.NoError(t, store.Save(sd, "1", []byte("sd")))
+	require.NoError(t, store.SavePlaylist(hd, "http://origin/1080p.m3u8", []byte("#EXTM3U\n1080p")))
+	require.NoError(t, store.SavePlaylist(sd, "http://origin/720p.m3u8", []byte("#EXTM3U\n720p")))
+
+	body, source, ok, err := store.LoadPlaylist(hd)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "#EXTM3U\n1080p", string(body))
+	assert.Equal(t, "http://origin/1080p.m3u8", source)
+
+	require.NoError(t, store.Remove(sd))
+	data, ok, err := store.Load(context.Background(), hd, "1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hd"), data)
+
+	reloaded, err := newFileSegmentStore(dir, 0, true)
+	require.NoError(t, err)
+	assert.Contains(t, reloaded.indexes, hd)
+	assert.NotContains(t, reloaded.indexes, sd)
+}
+
+func TestFileSegmentStoreMovesDirectoriesNamedWithoutTheHash(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileSegmentStore(dir, 0, true)
+	require.NoError(t, err)
+	require.NoError(t, store.Save("manifest", "1", []byte("segment")))
+	require.NoError(t, os.Rename(store.manifestRoot("manifest"), filepath.Join(dir, "manifest")))
+
+	reloaded, err := newFileSegmentStore(dir, 0, true)
+	require.NoError(t, err)
+	data, ok, err := reloaded.Load(context.Background(), "manifest", "1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("segment"), data)
+	assert.DirExists(t, reloaded.manifestRoot("manifest"))
+	assert.NoDirExists(t, filepath.Join(dir, "manifest"))
+}
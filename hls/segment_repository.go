@@ -0,0 +1,182 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tier names a layer of the segment repository, fastest first.
+type Tier string
+
+const (
+	TierPrefetch Tier = "prefetch"
+	TierMemory   Tier = "memory"
+	TierDisk     Tier = "disk"
+)
+
+var tiers = []Tier{TierPrefetch, TierMemory, TierDisk}
+
+// maxPromotedSegmentBytes caps the disk hits that are read into the memory tier; larger
+// segments keep being served from their file.
+const maxPromotedSegmentBytes = 16 << 20
+
+// TierStats counts lookups answered by a tier.
+type TierStats struct {
+	Hits uint64 `json:"hits"`
+}
+
+// RepositoryStats reports per-tier hits and lookups that no tier could answer.
+type RepositoryStats struct {
+	Tiers  map[Tier]TierStats `json:"tiers"`
+	Misses uint64             `json:"misses"`
+}
+
+/*
+SegmentRepository is the single lookup path for segment bytes the proxy already holds.
+It consults the prefetcher, then the in-memory cache, then the disk store. Disk hits are
+promoted into memory; segments are written through to both memory and disk, so a segment
+the memory tier evicts is demoted to being served from disk rather than lost.
+*/
+type SegmentRepository struct {
+	prefetcher *Prefetcher
+	hits       map[Tier]*atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func NewSegmentRepository(prefetcher *Prefetcher) *SegmentRepository {
+	hits := make(map[Tier]*atomic.Uint64, len(tiers))
+	for _, tier := range tiers {
+		hits[tier] = &atomic.Uint64{}
+	}
+	return &SegmentRepository{prefetcher: prefetcher, hits: hits}
+}
+
+// SegmentContent is a segment held by one of the tiers, positioned at its start and ready
+// to be served with http.ServeContent. Close it when done.
+type SegmentContent struct {
+	io.ReadSeeker
+	Size    int64
+	ModTime time.Time
+	ETag    string
+	file    *os.File
+}
+
+// Bytes reads the whole segment, for callers that must transform it before serving.
+func (c *SegmentContent) Bytes() ([]byte, error) {
+	if reader, ok := c.ReadSeeker.(*bytes.Reader); ok && c.file == nil {
+		data := make([]byte, reader.Size())
+		_, err := reader.ReadAt(data, 0)
+		return data, err
+	}
+	if _, err := c.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(c)
+}
+
+func (c *SegmentContent) Close() error {
+	if c.file != nil {
+		return c.file.Close()
+	}
+	return nil
+}
+
+// SegmentETag is the entity tag for a segment URL. Segment URLs are immutable in HLS, so the
+// URL and size identify the content whichever tier serves it.
+func SegmentETag(clipUrl string, size int64) string {
+	sum := sha1.Sum([]byte(clipUrl))
+	return fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(sum[:8]), size)
+}
+
+func bytesContent(clipUrl string, data []byte) *SegmentContent {
+	return &SegmentContent{
+		ReadSeeker: bytes.NewReader(data),
+		Size:       int64(len(data)),
+		ETag:       SegmentETag(clipUrl, int64(len(data))),
+	}
+}
+
+// Open returns the segment from the fastest tier that has it. playlistID is the pId the
+// player echoed back and may be empty; manifestID is the cache namespace for the segment.
+// Disk hits are promoted into the memory tier when a memory cache is active and the segment
+// is within maxPromotedSegmentBytes; otherwise the file store hands out the file itself.
+func (r *SegmentRepository) Open(ctx context.Context, playlistID, manifestID, clipUrl string) (*SegmentContent, Tier, bool) {
+	if playlistID != "" && model.Configuration.Prefetch && r.prefetcher != nil {
+		if data, ok := r.prefetcher.GetFetchedClip(playlistID, clipUrl); ok {
+			return r.hit(TierPrefetch, bytesContent(clipUrl, data))
+		}
+	}
+
+	if data, ok := LoadSegmentCache(manifestID, clipUrl); ok {
+		return r.hit(TierMemory, bytesContent(clipUrl, data))
+	}
+
+	file, info, ok, err := OpenSegment(manifestID, clipUrl)
+	if err != nil {
+		log.Error("Error opening stored segment: ", err)
+	}
+	if ok && promotable(info.Size()) {
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err == nil {
+			SaveSegmentCache(manifestID, clipUrl, data)
+			content := bytesContent(clipUrl, data)
+			content.ModTime = info.ModTime()
+			return r.hit(TierDisk, content)
+		}
+		log.Error("Error reading stored segment: ", err)
+		ok = false
+	}
+	if ok {
+		return r.hit(TierDisk, &SegmentContent{
+			ReadSeeker: file,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			ETag:       SegmentETag(clipUrl, info.Size()),
+			file:       file,
+		})
+	}
+
+	data, ok, err := LoadSegment(ctx, manifestID, clipUrl)
+	if err != nil {
+		log.Error("Error loading segment from store: ", err)
+	}
+	if ok {
+		SaveSegmentCache(manifestID, clipUrl, data)
+		return r.hit(TierDisk, bytesContent(clipUrl, data))
+	}
+
+	r.misses.Add(1)
+	return nil, "", false
+}
+
+func promotable(size int64) bool {
+	_, cached := activeCache()
+	return cached && size <= maxPromotedSegmentBytes
+}
+
+func (r *SegmentRepository) Stats() RepositoryStats {
+	stats := RepositoryStats{
+		Tiers:  make(map[Tier]TierStats, len(tiers)),
+		Misses: r.misses.Load(),
+	}
+	for _, tier := range tiers {
+		stats.Tiers[tier] = TierStats{Hits: r.hits[tier].Load()}
+	}
+	return stats
+}
+
+func (r *SegmentRepository) hit(tier Tier, content *SegmentContent) (*SegmentContent, Tier, bool) {
+	r.hits[tier].Add(1)
+	return content, tier, true
+}
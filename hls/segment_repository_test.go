@@ -0,0 +1,34 @@
+package hls
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentRepositoryPromotesDiskHitsIntoMemory(t *testing.T) {
+	t.Cleanup(func() {
+		ConfigureSegmentCache(false, 0)
+		_ = ConfigureSegmentStore(false, "", false)
+	})
+	ConfigureSegmentCache(true, 1<<20)
+	require.NoError(t, ConfigureSegmentStore(true, t.TempDir(), false))
+	require.NoError(t, SaveSegment("manifest", "http://origin/a.ts", []byte("segment")))
+
+	repository := NewSegmentRepository(nil)
+	content, tier, ok := repository.Open(context.Background(), "", "manifest", "http://origin/a.ts")
+	require.True(t, ok)
+	assert.Equal(t, TierDisk, tier)
+	data, err := content.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("segment"), data)
+	require.NoError(t, content.Close())
+
+	// the second lookup no longer touches the disk
+	content, tier, ok = repository.Open(context.Background(), "", "manifest", "http://origin/a.ts")
+	require.True(t, ok)
+	assert.Equal(t, TierMemory, tier)
+	require.NoError(t, content.Close())
+}
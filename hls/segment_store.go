@@ -1,6 +1,7 @@
 package hls
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
@@ -12,7 +13,6 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/bariiss/hls-proxy/model"
 	log "github.com/sirupsen/logrus"
@@ -20,27 +20,56 @@ import (
 
 type segmentStore interface {
 	Save(manifestID, key string, data []byte) error
-	Load(manifestID, key string) ([]byte, bool, error)
+	Load(ctx context.Context, manifestID, key string) ([]byte, bool, error)
 	Remove(manifestID string) error
+	SavePlaylist(manifestID, sourceURL string, body []byte) error
+	LoadPlaylist(manifestID string) ([]byte, string, bool, error)
 }
 
 type noopSegmentStore struct{}
 
-func (noopSegmentStore) Save(string, string, []byte) error         { return nil }
-func (noopSegmentStore) Load(string, string) ([]byte, bool, error) { return nil, false, nil }
+func (noopSegmentStore) Save(string, string, []byte) error { return nil }
+func (noopSegmentStore) Load(context.Context, string, string) ([]byte, bool, error) {
+	return nil, false, nil
+}
 func (noopSegmentStore) Remove(string) error                       { return nil }
+func (noopSegmentStore) SavePlaylist(string, string, []byte) error { return nil }
+func (noopSegmentStore) LoadPlaylist(string) ([]byte, string, bool, error) {
+	return nil, "", false, nil
+}
 
 type fileSegmentStore struct {
-	baseDir string
-	limit   int
-	mu      sync.Mutex
+	baseDir      string
+	limit        int
+	maxBytes     int64
+	minFreeBytes int64
+	persistent   bool
+	indexes      map[string]*manifestIndex
+	refs         map[string]int
+	totalBytes   int64
+	evictions    uint64
+	full         bool
+	stop         chan struct{}
+	mu           sync.Mutex
 }
 
-func newFileSegmentStore(baseDir string, limit int) (*fileSegmentStore, error) {
+func newFileSegmentStore(baseDir string, limit int, persistent bool) (*fileSegmentStore, error) {
 	if err := os.MkdirAll(baseDir, 0o755); err != nil {
 		return nil, fmt.Errorf("create segment directory: %w", err)
 	}
-	return &fileSegmentStore{baseDir: baseDir, limit: limit}, nil
+	s := &fileSegmentStore{
+		baseDir:    baseDir,
+		limit:      limit,
+		persistent: persistent,
+		indexes:    make(map[string]*manifestIndex),
+		refs:       make(map[string]int),
+	}
+	if persistent {
+		if err := s.loadIndexes(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (s *fileSegmentStore) Save(manifestID, key string, data []byte) error {
@@ -48,91 +77,44 @@ func (s *fileSegmentStore) Save(manifestID, key string, data []byte) error {
 		return nil
 	}
 
+	blob := blobHash(data)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	path := s.pathFor(manifestID, key)
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return fmt.Errorf("create segment path: %w", err)
-	}
-
-	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
-		return fmt.Errorf("write segment temp file: %w", err)
-	}
-
-	if err := os.Rename(tmp, path); err != nil {
-		// attempt to remove temp file on failure to avoid leftovers
-		_ = os.Remove(tmp)
-		return fmt.Errorf("finalize segment file: %w", err)
+	if err := s.retainBlobLocked(blob, data); err != nil {
+		return err
 	}
 
+	s.recordLocked(manifestID, key, len(data), blob)
 	s.enforceLimitLocked(manifestID)
+	s.enforceQuotaLocked()
+	if s.persistent {
+		if err := s.writeIndexLocked(manifestID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-type storedSegmentFile struct {
-	path    string
-	modTime time.Time
-}
-
+// enforceLimitLocked removes the earliest fetched segments beyond the per-manifest limit.
+// A persistent store keeps every segment of a complete (#EXT-X-ENDLIST) playlist for replay.
 func (s *fileSegmentStore) enforceLimitLocked(manifestID string) {
-	if s.limit <= 0 {
-		return
-	}
-
-	manifestRoot := s.manifestRoot(manifestID)
-	if manifestRoot == "" {
-		return
-	}
-
-	info, statErr := os.Stat(manifestRoot)
-	if errors.Is(statErr, os.ErrNotExist) {
-		return
-	}
-	if statErr != nil {
-		log.Warnf("inspect segment directory for %s: %v", manifestID, statErr)
-		return
-	}
-	if !info.IsDir() {
-		return
-	}
-
-	var files []storedSegmentFile
-	err := filepath.Walk(manifestRoot, func(path string, info os.FileInfo, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if !strings.HasSuffix(info.Name(), ".seg") {
-			return nil
-		}
-		files = append(files, storedSegmentFile{path: path, modTime: info.ModTime()})
-		return nil
-	})
-	if err != nil {
-		log.Warnf("walk segment directory for %s: %v", manifestID, err)
+	index, ok := s.indexes[manifestID]
+	if s.limit <= 0 || !ok || len(index.Segments) <= s.limit || (s.persistent && index.Complete) {
 		return
 	}
 
-	if len(files) <= s.limit {
-		return
+	records := make([]*segmentRecord, 0, len(index.Segments))
+	for _, record := range index.Segments {
+		records = append(records, record)
 	}
-
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].modTime.Before(files[j].modTime)
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].FetchedAt.Before(records[j].FetchedAt)
 	})
 
-	excess := len(files) - s.limit
-	for i := range excess {
-		removePath := files[i].path
-		if err := os.Remove(removePath); err != nil && !errors.Is(err, os.ErrNotExist) {
-			log.Warnf("remove stale segment %s: %v", removePath, err)
-			continue
-		}
-		cleanupEmptyDirs(filepath.Dir(removePath), manifestRoot)
+	for _, record := range records[:len(records)-s.limit] {
+		s.removeRecordLocked(index, record)
 	}
 }
 
@@ -161,11 +143,14 @@ func cleanupEmptyDirs(start, stop string) {
 	}
 }
 
-func (s *fileSegmentStore) Load(manifestID, key string) ([]byte, bool, error) {
+func (s *fileSegmentStore) Load(_ context.Context, manifestID, key string) ([]byte, bool, error) {
 	if manifestID == "" {
 		return nil, false, nil
 	}
-	path := s.pathFor(manifestID, key)
+	path, ok := s.locate(manifestID, key)
+	if !ok {
+		return nil, false, nil
+	}
 	data, err := os.ReadFile(path)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, false, nil
@@ -176,7 +161,32 @@ func (s *fileSegmentStore) Load(manifestID, key string) ([]byte, bool, error) {
 	return data, true, nil
 }
 
-func (s *fileSegmentStore) pathFor(manifestID, key string) string {
+// Open returns the stored file itself so it can be served without copying it into memory.
+func (s *fileSegmentStore) Open(manifestID, key string) (*os.File, os.FileInfo, bool, error) {
+	if manifestID == "" {
+		return nil, nil, false, nil
+	}
+	path, ok := s.locate(manifestID, key)
+	if !ok {
+		return nil, nil, false, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("open segment file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, false, fmt.Errorf("stat segment file: %w", err)
+	}
+	return file, info, true, nil
+}
+
+// legacyPathFor is where segments were stored before they moved into shared blobs.
+func (s *fileSegmentStore) legacyPathFor(manifestID, key string) string {
 	sum := sha1.Sum([]byte(key))
 	hexKey := hex.EncodeToString(sum[:])
 	return filepath.Join(s.manifestRoot(manifestID), hexKey[:2], hexKey[2:]+".seg")
@@ -200,6 +210,12 @@ func (s *fileSegmentStore) Remove(manifestID string) error {
 	if root == "" {
 		return nil
 	}
+	if index, ok := s.indexes[manifestID]; ok {
+		for _, record := range index.Segments {
+			s.releaseBlobLocked(record.Blob, record.Size)
+		}
+		delete(s.indexes, manifestID)
+	}
 	if err := os.RemoveAll(root); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("remove manifest segments: %w", err)
 	}
@@ -207,31 +223,60 @@ func (s *fileSegmentStore) Remove(manifestID string) error {
 }
 
 var (
-	storeMu       sync.RWMutex
-	activeStore   segmentStore = noopSegmentStore{}
-	storeEnabled  bool
-	storeBaseDir  string
-	cleanupSignal sync.Once
+	storeMu         sync.RWMutex
+	activeStore     segmentStore = noopSegmentStore{}
+	storeEnabled    bool
+	storePersistent bool
+	storeShared     bool
+	storeBaseDir    string
+	cleanupSignal   sync.Once
 )
 
 // ConfigureSegmentStore switches the active segment storage implementation.
-func ConfigureSegmentStore(enabled bool, baseDir string) error {
+// A persistent store keeps its files and index across restarts instead of wiping them on shutdown.
+func ConfigureSegmentStore(enabled bool, baseDir string, persistent bool) error {
 	storeMu.Lock()
 	defer storeMu.Unlock()
 
+	if previous, ok := activeStore.(*fileSegmentStore); ok {
+		previous.stopCompactor()
+	}
 	if !enabled {
 		activeStore = noopSegmentStore{}
 		storeEnabled = false
+		storePersistent = false
+		storeShared = false
+		storeBaseDir = ""
+		return nil
+	}
+
+	if strings.EqualFold(model.Configuration.SegmentStoreBackend, "s3") {
+		store, err := newS3SegmentStore(S3OptionsFromConfig(model.Configuration), persistent)
+		if err != nil {
+			return err
+		}
+		activeStore = store
+		storeEnabled = true
+		storePersistent = persistent
+		// a shared bucket is never wiped on shutdown or by the idle janitor
+		storeShared = true
 		storeBaseDir = ""
 		return nil
 	}
 
-	fs, err := newFileSegmentStore(baseDir, model.Configuration.SegmentCount)
+	fs, err := newFileSegmentStore(baseDir, model.Configuration.SegmentCount, persistent)
 	if err != nil {
 		return err
 	}
+	fs.maxBytes = model.Configuration.SegmentStoreMaxBytes
+	fs.minFreeBytes = model.Configuration.SegmentStoreMinFreeBytes
+	// a quota lowered since the last run applies to what was loaded from disk right away
+	fs.compact()
+	fs.startCompactor(model.Configuration.JanitorInterval)
 	activeStore = fs
 	storeEnabled = true
+	storePersistent = persistent
+	storeShared = false
 	storeBaseDir = baseDir
 	registerCleanup()
 	return nil
@@ -248,15 +293,60 @@ func SaveSegment(manifestID, key string, data []byte) error {
 	return store.Save(manifestID, key, data)
 }
 
-// LoadSegment retrieves the stored payload for the supplied key.
-func LoadSegment(manifestID, key string) ([]byte, bool, error) {
+// LoadSegment retrieves the stored payload for the supplied key. ctx bounds lookups in
+// remote stores.
+func LoadSegment(ctx context.Context, manifestID, key string) ([]byte, bool, error) {
 	storeMu.RLock()
 	store := activeStore
 	storeMu.RUnlock()
 	if !storeEnabled || manifestID == "" {
 		return nil, false, nil
 	}
-	return store.Load(manifestID, key)
+	return store.Load(ctx, manifestID, key)
+}
+
+// OpenSegment returns the stored file for a segment when the active store keeps segments as
+// local files. ok is false for misses and for stores that cannot hand out files.
+func OpenSegment(manifestID, key string) (*os.File, os.FileInfo, bool, error) {
+	storeMu.RLock()
+	store := activeStore
+	storeMu.RUnlock()
+	fs, isFile := store.(*fileSegmentStore)
+	if !storeEnabled || !isFile || manifestID == "" {
+		return nil, nil, false, nil
+	}
+	return fs.Open(manifestID, key)
+}
+
+// MarkPlaylistComplete records that a playlist carries #EXT-X-ENDLIST, which lifts the
+// per-manifest limit of a persistent file store so the whole VOD stream stays on disk.
+// Live playlists keep the rolling window and never grow without bound.
+func MarkPlaylistComplete(manifestID string) {
+	storeMu.RLock()
+	store := activeStore
+	storeMu.RUnlock()
+	fs, isFile := store.(*fileSegmentStore)
+	if !storeEnabled || !isFile || manifestID == "" {
+		return
+	}
+	fs.markComplete(manifestID)
+}
+
+func (s *fileSegmentStore) markComplete(manifestID string) {
+	if !s.persistent {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexFor(manifestID)
+	if index.Complete {
+		return
+	}
+	index.Complete = true
+	if err := s.writeIndexLocked(manifestID); err != nil {
+		log.Warnf("write segment index for %s: %v", manifestID, err)
+	}
 }
 
 // RemoveManifestSegments deletes all persisted segments for a manifest, if segment storage is active.
@@ -272,12 +362,45 @@ func RemoveManifestSegments(manifestID string) error {
 	return store.Remove(manifestID)
 }
 
-// CleanupSegmentStore removes any persisted segments from disk.
+// SavePlaylist keeps a copy of an upstream playlist next to its segments when the store is persistent.
+func SavePlaylist(manifestID, sourceURL string, body []byte) error {
+	storeMu.RLock()
+	store := activeStore
+	enabled := storeEnabled
+	storeMu.RUnlock()
+	if !enabled || manifestID == "" {
+		return nil
+	}
+	return store.SavePlaylist(manifestID, sourceURL, body)
+}
+
+// LoadPlaylist returns a playlist saved by SavePlaylist along with the URL it was fetched from.
+func LoadPlaylist(manifestID string) ([]byte, string, bool, error) {
+	storeMu.RLock()
+	store := activeStore
+	enabled := storeEnabled
+	storeMu.RUnlock()
+	if !enabled || manifestID == "" {
+		return nil, "", false, nil
+	}
+	return store.LoadPlaylist(manifestID)
+}
+
+// idleRemovesStoredSegments reports whether the idle janitor deletes a manifest's stored
+// segments. Persistent stores keep them, and a shared bucket keeps them because another
+// replica may still be serving the manifest; bucket lifecycle rules expire those objects.
+func idleRemovesStoredSegments() bool {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return storeEnabled && !storePersistent && !storeShared
+}
+
+// CleanupSegmentStore removes any persisted segments from disk. Persistent stores are kept.
 func CleanupSegmentStore() error {
 	storeMu.Lock()
 	defer storeMu.Unlock()
 
-	if !storeEnabled || storeBaseDir == "" {
+	if !storeEnabled || storeBaseDir == "" || storePersistent {
 		return nil
 	}
 
@@ -288,12 +411,16 @@ func CleanupSegmentStore() error {
 	if baseDir != "" {
 		_ = os.MkdirAll(baseDir, 0o755)
 	}
+	if previous, ok := activeStore.(*fileSegmentStore); ok {
+		previous.stopCompactor()
+	}
 	storeEnabled = false
 	storeBaseDir = ""
 	activeStore = noopSegmentStore{}
 	return nil
 }
 
+// sanitizeManifestID names the directory, or object prefix, holding a manifest's segments.
 func sanitizeManifestID(id string) string {
 	id = strings.TrimSpace(id)
 	replacer := strings.NewReplacer(
@@ -311,12 +438,15 @@ func sanitizeManifestID(id string) string {
 	)
 	sanitized := replacer.Replace(id)
 	if sanitized == "" {
-		return "manifest"
+		sanitized = "manifest"
 	}
-	if len(sanitized) > 120 {
-		return sanitized[:120]
+	if len(sanitized) > 80 {
+		sanitized = sanitized[:80]
 	}
-	return sanitized
+	// manifest keys of one stream share long prefixes and lose characters above, so only a
+	// hash of the whole ID keeps their directories apart
+	sum := sha1.Sum([]byte(id))
+	return sanitized + "-" + hex.EncodeToString(sum[:8])
 }
 
 func registerCleanup() {
@@ -0,0 +1,453 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/model"
+)
+
+const (
+	s3SourceURLHeader = "X-Amz-Meta-Source-Url"
+	s3Service         = "s3"
+	// s3LookupTimeout bounds a segment lookup a player waits on before the origin is tried.
+	s3LookupTimeout = 2 * time.Second
+	// s3MissTTL is how long a missing segment, or a failing bucket, is not asked again.
+	s3MissTTL = 30 * time.Second
+	// s3MaxMisses bounds the remembered misses; older ones are dropped past it.
+	s3MaxMisses = 4096
+)
+
+// S3Options configures the S3-compatible segment store.
+type S3Options struct {
+	Endpoint     string
+	Bucket       string
+	Prefix       string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle addresses the bucket as endpoint/bucket/key instead of bucket.endpoint/key,
+	// which most self-hosted S3 implementations require.
+	PathStyle bool
+	Timeout   time.Duration
+}
+
+/*
+s3SegmentStore keeps segments in an S3-compatible bucket so several proxy replicas share one
+archive. Objects are laid out like the file store: <prefix>/<manifest>/<sha1 of url>.seg, with
+the manifest playlist next to them. Requests are signed with AWS Signature Version 4.
+Retention is left to the bucket's lifecycle rules; the store itself does not enforce a quota.
+Lookups sit in front of origin fetches, so they give up after s3LookupTimeout, and segments
+found missing, or every segment while the bucket fails, are not looked up again for s3MissTTL.
+*/
+type s3SegmentStore struct {
+	opts       S3Options
+	endpoint   *url.URL
+	client     *http.Client
+	persistent bool
+
+	mu        sync.Mutex
+	missed    map[string]time.Time
+	downUntil time.Time
+}
+
+// S3OptionsFromConfig collects the S3 settings from the proxy configuration.
+func S3OptionsFromConfig(c model.Config) S3Options {
+	return S3Options{
+		Endpoint:     c.S3Endpoint,
+		Bucket:       c.S3Bucket,
+		Prefix:       c.S3Prefix,
+		Region:       c.S3Region,
+		AccessKey:    c.S3AccessKey,
+		SecretKey:    c.S3SecretKey,
+		SessionToken: c.S3SessionToken,
+		PathStyle:    c.S3PathStyle,
+		Timeout:      config.Settings.HTTPClientTimeout,
+	}
+}
+
+func newS3SegmentStore(opts S3Options, persistent bool) (*s3SegmentStore, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("s3 segment store: bucket is required")
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = "https://s3.amazonaws.com"
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 segment store: invalid endpoint %q", opts.Endpoint)
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	return &s3SegmentStore{
+		opts:       opts,
+		endpoint:   endpoint,
+		client:     &http.Client{Timeout: timeout},
+		persistent: persistent,
+		missed:     make(map[string]time.Time),
+	}, nil
+}
+
+func (s *s3SegmentStore) manifestPrefix(manifestID string) string {
+	if s.opts.Prefix == "" {
+		return sanitizeManifestID(manifestID) + "/"
+	}
+	return s.opts.Prefix + "/" + sanitizeManifestID(manifestID) + "/"
+}
+
+func (s *s3SegmentStore) segmentKey(manifestID, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return s.manifestPrefix(manifestID) + hex.EncodeToString(sum[:]) + ".seg"
+}
+
+func (s *s3SegmentStore) Save(manifestID, key string, data []byte) error {
+	if len(data) == 0 || manifestID == "" {
+		return nil
+	}
+	objectKey := s.segmentKey(manifestID, key)
+	resp, err := s.do(context.Background(), http.MethodPut, objectKey, nil, data, nil)
+	if err != nil {
+		return fmt.Errorf("upload segment: %w", err)
+	}
+	resp.Body.Close()
+	s.mu.Lock()
+	delete(s.missed, objectKey)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *s3SegmentStore) Load(ctx context.Context, manifestID, key string) ([]byte, bool, error) {
+	if manifestID == "" {
+		return nil, false, nil
+	}
+	objectKey := s.segmentKey(manifestID, key)
+	if s.skipLookup(objectKey) {
+		return nil, false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s3LookupTimeout)
+	defer cancel()
+	data, ok, err := s.get(ctx, objectKey)
+	s.recordLookup(objectKey, ok, err)
+	return data, ok, err
+}
+
+// skipLookup reports whether objectKey was recently found missing or the bucket is failing.
+func (s *s3SegmentStore) skipLookup(objectKey string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Before(s.downUntil) {
+		return true
+	}
+	until, ok := s.missed[objectKey]
+	if ok && now.After(until) {
+		delete(s.missed, objectKey)
+		return false
+	}
+	return ok
+}
+
+func (s *s3SegmentStore) recordLookup(objectKey string, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	switch {
+	case err != nil:
+		s.downUntil = now.Add(s3MissTTL)
+	case !found:
+		if len(s.missed) >= s3MaxMisses {
+			for key, until := range s.missed {
+				if now.After(until) {
+					delete(s.missed, key)
+				}
+			}
+			if len(s.missed) >= s3MaxMisses {
+				clear(s.missed)
+			}
+		}
+		s.missed[objectKey] = now.Add(s3MissTTL)
+	}
+}
+
+func (s *s3SegmentStore) Remove(manifestID string) error {
+	if manifestID == "" {
+		return nil
+	}
+	keys, err := s.list(s.manifestPrefix(manifestID))
+	if err != nil {
+		return fmt.Errorf("list manifest segments: %w", err)
+	}
+	for _, key := range keys {
+		resp, err := s.do(context.Background(), http.MethodDelete, key, nil, nil, nil)
+		if err != nil {
+			return fmt.Errorf("remove manifest segments: %w", err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *s3SegmentStore) SavePlaylist(manifestID, sourceURL string, body []byte) error {
+	if !s.persistent || manifestID == "" || len(body) == 0 {
+		return nil
+	}
+	header := http.Header{}
+	header.Set(s3SourceURLHeader, sourceURL)
+	resp, err := s.do(context.Background(), http.MethodPut, s.manifestPrefix(manifestID)+playlistFileName, nil, body, header)
+	if err != nil {
+		return fmt.Errorf("upload playlist: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3SegmentStore) LoadPlaylist(manifestID string) ([]byte, string, bool, error) {
+	if !s.persistent || manifestID == "" {
+		return nil, "", false, nil
+	}
+	resp, err := s.do(context.Background(), http.MethodGet, s.manifestPrefix(manifestID)+playlistFileName, nil, nil, nil)
+	if errors.Is(err, errS3NotFound) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, fmt.Errorf("read stored playlist: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("read stored playlist: %w", err)
+	}
+	sourceURL := resp.Header.Get(s3SourceURLHeader)
+	if sourceURL == "" {
+		return nil, "", false, nil
+	}
+	return data, sourceURL, true, nil
+}
+
+func (s *s3SegmentStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if errors.Is(err, errS3NotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("download segment: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("download segment: %w", err)
+	}
+	return data, true, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns every object key under prefix, following ListObjectsV2 continuation tokens.
+func (s *s3SegmentStore) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(context.Background(), http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode object listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+var errS3NotFound = errors.New("s3 object not found")
+
+// do sends a signed request for key (or the bucket itself when key is empty). Responses
+// other than 2xx are closed and turned into errors; 404 becomes errS3NotFound.
+func (s *s3SegmentStore) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := *s.endpoint
+	objectPath := key
+	if s.opts.PathStyle {
+		objectPath = s.opts.Bucket + "/" + key
+	} else {
+		target.Host = s.opts.Bucket + "." + target.Host
+	}
+	target.Path = path.Join("/", strings.TrimSuffix(s.endpoint.Path, "/"), objectPath)
+	if key == "" && !strings.HasSuffix(target.Path, "/") {
+		target.Path += "/"
+	}
+	target.RawPath = s3EscapePath(target.Path)
+	target.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errS3NotFound
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(detail)))
+}
+
+// sign adds AWS Signature Version 4 headers to req. Anonymous access is used when no
+// credentials are configured.
+func (s *s3SegmentStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	if s.opts.AccessKey == "" || s.opts.SecretKey == "" {
+		return
+	}
+
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + s.opts.Region + "/" + s3Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), date)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, as SigV4 requires.
+func s3Escape(value string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,233 @@
+package hls
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeS3Object struct {
+	data     []byte
+	metadata http.Header
+}
+
+// fakeS3 is a path-style, in-memory stand-in for the handful of S3 calls the store makes.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]fakeS3Object
+	gets    int
+	delay   time.Duration
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+		}
+		prefix := r.URL.Query().Get("prefix")
+		keys := make([]string, 0, len(f.objects))
+		for key := range f.objects {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{key})
+		}
+		_ = xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		metadata := http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				metadata[name] = values
+			}
+		}
+		f.objects[key] = fakeS3Object{data: data, metadata: metadata}
+	case r.Method == http.MethodGet:
+		f.gets++
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		_, _ = w.Write(object.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3SegmentStoreRoundTrip(t *testing.T) {
+	fake := &fakeS3{bucket: "archive", objects: make(map[string]fakeS3Object)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := newS3SegmentStore(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "archive",
+		Prefix:    "replicas",
+		AccessKey: "test-key",
+		SecretKey: "test-secret",
+		PathStyle: true,
+	}, true)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("manifest", "http://origin/a.ts?token=1", []byte("segment")))
+	data, ok, err := store.Load(context.Background(), "manifest", "http://origin/a.ts?token=1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("segment"), data)
+
+	_, ok, err = store.Load(context.Background(), "manifest", "http://origin/missing.ts")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.SavePlaylist("manifest", "http://origin/index.m3u8", []byte("#EXTM3U")))
+	body, source, ok, err := store.LoadPlaylist("manifest")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "#EXTM3U", string(body))
+	assert.Equal(t, "http://origin/index.m3u8", source)
+
+	require.NoError(t, store.Remove("manifest"))
+	assert.Empty(t, fake.objects)
+}
+
+func TestS3SegmentStoreUploadsAfterServingAndSurvivesIdleCleanup(t *testing.T) {
+	fake := &fakeS3{bucket: "archive", objects: make(map[string]fakeS3Object)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	previous := model.Configuration
+	t.Cleanup(func() {
+		model.Configuration = previous
+		_ = ConfigureSegmentStore(false, "", false)
+	})
+	model.Configuration.SegmentStoreBackend = "s3"
+	model.Configuration.S3Endpoint = server.URL
+	model.Configuration.S3Bucket = "archive"
+	model.Configuration.S3AccessKey = "test-key"
+	model.Configuration.S3SecretKey = "test-secret"
+	model.Configuration.S3PathStyle = true
+	require.NoError(t, ConfigureSegmentStore(true, "", false))
+
+	segment, leader, err := FetchSegmentOnce("manifest", "http://origin/a.ts", func() (FetchedSegment, error) {
+		return FetchedSegment{Data: []byte("segment")}, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, leader)
+	assert.Equal(t, []byte("segment"), segment.Data)
+
+	assert.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.objects) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the bucket is shared with other replicas, so going idle here must not empty it
+	assert.False(t, idleRemovesStoredSegments())
+}
+
+func TestS3SegmentStoreDoesNotAskAgainForRecentlyMissedSegments(t *testing.T) {
+	fake := &fakeS3{bucket: "archive", objects: make(map[string]fakeS3Object)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := newS3SegmentStore(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "archive",
+		AccessKey: "test-key",
+		SecretKey: "test-secret",
+		PathStyle: true,
+	}, false)
+	require.NoError(t, err)
+
+	for range 3 {
+		_, ok, err := store.Load(context.Background(), "manifest", "http://origin/a.ts")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 1, fake.gets)
+
+	// a segment this replica saved is looked up again
+	require.NoError(t, store.Save("manifest", "http://origin/a.ts", []byte("segment")))
+	data, ok, err := store.Load(context.Background(), "manifest", "http://origin/a.ts")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("segment"), data)
+	assert.Equal(t, 2, fake.gets)
+}
+
+func TestS3SegmentStoreLookupsFollowTheRequestContext(t *testing.T) {
+	fake := &fakeS3{bucket: "archive", objects: make(map[string]fakeS3Object), delay: time.Second}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := newS3SegmentStore(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "archive",
+		AccessKey: "test-key",
+		SecretKey: "test-secret",
+		PathStyle: true,
+	}, false)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, ok, err := store.Load(ctx, "manifest", "http://origin/a.ts")
+	assert.Error(t, err)
+	assert.False(t, ok)
+	assert.Less(t, time.Since(started), 500*time.Millisecond)
+
+	// while the bucket is failing, further lookups go straight to the origin
+	started = time.Now()
+	_, ok, err = store.Load(context.Background(), "manifest", "http://origin/b.ts")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+}
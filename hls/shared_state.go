@@ -0,0 +1,105 @@
+package hls
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+sharedState holds the parts of manifest bookkeeping that must agree across proxy replicas
+behind a load balancer: the sequence number given to each segment URL, the playlist ID of a
+manifest and when a player last asked for it. The default is process-local; the redis backend
+shares it, along with small segments, between every replica pointing at the same server.
+*/
+type sharedState interface {
+	// AssignSequences returns the sequence number for each clip, allocating new numbers for
+	// clips no replica has seen before. dropped clips have left the window and are forgotten.
+	AssignSequences(manifestKey string, clips []string, dropped []string) ([]int, error)
+	// PlaylistID returns the playlist ID already chosen for the manifest, or claims candidate.
+	PlaylistID(manifestKey, candidate string) (string, error)
+	Touch(manifestKey string, at time.Time) error
+	LastAccess(manifestKey string) (time.Time, bool, error)
+	Forget(manifestKey string) error
+}
+
+var (
+	sharedMu     sync.RWMutex
+	activeShared sharedState
+	sharedCache  *redisSegmentCache
+)
+
+// ConfigureSharedState selects where manifest state and small segments are shared between
+// replicas. "memory" keeps everything in this process; "redis" uses c.RedisURL.
+func ConfigureSharedState(c *model.Config) error {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if !strings.EqualFold(c.StateBackend, "redis") {
+		activeShared = nil
+		sharedCache = nil
+		return nil
+	}
+
+	state, err := newRedisState(c.RedisURL, c.RedisPrefix, c.PlaylistRetention)
+	if err != nil {
+		return err
+	}
+	activeShared = state
+	sharedCache = newRedisSegmentCache(state, c.RedisSegmentMaxBytes, c.ClipRetention)
+	return nil
+}
+
+func currentSharedState() sharedState {
+	sharedMu.RLock()
+	defer sharedMu.RUnlock()
+	return activeShared
+}
+
+func currentSharedCache() *redisSegmentCache {
+	sharedMu.RLock()
+	defer sharedMu.RUnlock()
+	return sharedCache
+}
+
+// shareTouch records player activity for a manifest with the other replicas.
+func shareTouch(manifestKey string, at time.Time) {
+	state := currentSharedState()
+	if state == nil || manifestKey == "" {
+		return
+	}
+	if err := state.Touch(manifestKey, at); err != nil {
+		log.Warn("Failed to share manifest activity: ", err)
+	}
+}
+
+// sharedLastAccess reports the most recent player activity any replica recorded.
+func sharedLastAccess(manifestKey string) (time.Time, bool) {
+	state := currentSharedState()
+	if state == nil || manifestKey == "" {
+		return time.Time{}, false
+	}
+	at, ok, err := state.LastAccess(manifestKey)
+	if err != nil {
+		log.Warn("Failed to read shared manifest activity: ", err)
+		return time.Time{}, false
+	}
+	return at, ok
+}
+
+func shareForget(manifestKey string) {
+	state := currentSharedState()
+	if state == nil || manifestKey == "" {
+		return
+	}
+	if err := state.Forget(manifestKey); err != nil {
+		log.Warn("Failed to forget shared manifest state: ", err)
+	}
+}
+
+func logSharedCacheError(op string, err error) {
+	log.Warnf("Shared segment cache %s failed: %v", op, err)
+}
@@ -0,0 +1,245 @@
+package hls
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// assignSequencesScript hands out sequence numbers atomically so two replicas merging the
+// same playlist at once still agree on them.
+var assignSequencesScript = redis.NewScript(`
+local n = tonumber(ARGV[2])
+local out = {}
+for i = 1, n do
+	local clip = ARGV[2 + i]
+	local seq = redis.call('HGET', KEYS[1], clip)
+	if not seq then
+		seq = redis.call('INCR', KEYS[2]) - 1
+		redis.call('HSET', KEYS[1], clip, seq)
+	end
+	out[i] = tonumber(seq)
+end
+for i = 3 + n, #ARGV do
+	redis.call('HDEL', KEYS[1], ARGV[i])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return out
+`)
+
+type redisState struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func newRedisState(rawURL, prefix string, ttl time.Duration) (*redisState, error) {
+	if rawURL == "" {
+		return nil, errors.New("redis state backend: redis URL is required")
+	}
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("redis state backend: %w", err)
+	}
+	if ttl <= 0 {
+		ttl = 5 * time.Hour
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis state backend: %w", err)
+	}
+	return &redisState{client: client, prefix: prefix, ttl: ttl}, nil
+}
+
+func (r *redisState) key(kind, id string) string {
+	return r.prefix + ":" + kind + ":" + id
+}
+
+func (r *redisState) AssignSequences(manifestKey string, clips []string, dropped []string) ([]int, error) {
+	if len(clips) == 0 && len(dropped) == 0 {
+		return nil, nil
+	}
+	args := make([]any, 0, 2+len(clips)+len(dropped))
+	args = append(args, r.ttl.Milliseconds(), len(clips))
+	for _, clip := range clips {
+		args = append(args, clip)
+	}
+	for _, clip := range dropped {
+		args = append(args, clip)
+	}
+
+	keys := []string{r.key("seq", manifestKey), r.key("next", manifestKey)}
+	values, err := assignSequencesScript.Run(context.Background(), r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	sequences := make([]int, len(values))
+	for i, value := range values {
+		sequences[i] = int(value)
+	}
+	return sequences, nil
+}
+
+func (r *redisState) PlaylistID(manifestKey, candidate string) (string, error) {
+	ctx := context.Background()
+	key := r.key("pid", manifestKey)
+	if err := r.client.SetNX(ctx, key, candidate, r.ttl).Err(); err != nil {
+		return "", err
+	}
+	id, err := r.client.Get(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+	r.client.Expire(ctx, key, r.ttl)
+	return id, nil
+}
+
+func (r *redisState) Touch(manifestKey string, at time.Time) error {
+	return r.client.Set(context.Background(), r.key("access", manifestKey), at.UnixNano(), r.ttl).Err()
+}
+
+func (r *redisState) LastAccess(manifestKey string) (time.Time, bool, error) {
+	value, err := r.client.Get(context.Background(), r.key("access", manifestKey)).Result()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, nanos), true, nil
+}
+
+func (r *redisState) Forget(manifestKey string) error {
+	return r.client.Del(context.Background(),
+		r.key("seq", manifestKey),
+		r.key("next", manifestKey),
+		r.key("pid", manifestKey),
+		r.key("access", manifestKey),
+	).Err()
+}
+
+/*
+redisSegmentCache shares segments no larger than maxBytes between replicas. It sits behind
+the local cache: local hits never touch redis, and segments found in redis are copied into
+the local cache. Entries expire after the clip retention.
+*/
+type redisSegmentCache struct {
+	state    *redisState
+	local    segmentCacheStore
+	maxBytes int64
+	ttl      time.Duration
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+func newRedisSegmentCache(state *redisState, maxBytes int64, ttl time.Duration) *redisSegmentCache {
+	if ttl <= 0 {
+		ttl = 30 * time.Minute
+	}
+	return &redisSegmentCache{state: state, maxBytes: maxBytes, ttl: ttl}
+}
+
+// over returns a copy of the shared cache layered over the given local cache.
+func (c *redisSegmentCache) over(local segmentCacheStore) *redisSegmentCache {
+	return &redisSegmentCache{state: c.state, local: local, maxBytes: c.maxBytes, ttl: c.ttl}
+}
+
+func (c *redisSegmentCache) segmentKey(manifestID, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return c.state.key("seg", manifestID+":"+hex.EncodeToString(sum[:]))
+}
+
+func (c *redisSegmentCache) Save(manifestID, key string, data []byte) {
+	c.local.Save(manifestID, key, data)
+	if len(data) == 0 || manifestID == "" || key == "" {
+		return
+	}
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	ctx := context.Background()
+	index := c.state.key("segs", manifestID)
+	segmentKey := c.segmentKey(manifestID, key)
+	_, err := c.state.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, segmentKey, data, c.ttl)
+		pipe.SAdd(ctx, index, segmentKey)
+		pipe.Expire(ctx, index, c.ttl)
+		return nil
+	})
+	if err != nil {
+		logSharedCacheError("store", err)
+	}
+}
+
+func (c *redisSegmentCache) Load(manifestID, key string) ([]byte, bool) {
+	if data, ok := c.local.Load(manifestID, key); ok {
+		return data, true
+	}
+	if manifestID == "" || key == "" {
+		return nil, false
+	}
+
+	data, err := c.state.client.Get(context.Background(), c.segmentKey(manifestID, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		c.misses.Add(1)
+		return nil, false
+	}
+	if err != nil {
+		logSharedCacheError("load", err)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.local.Save(manifestID, key, data)
+	return data, true
+}
+
+func (c *redisSegmentCache) Remove(manifestID string) {
+	c.local.Remove(manifestID)
+	if manifestID == "" {
+		return
+	}
+
+	ctx := context.Background()
+	index := c.state.key("segs", manifestID)
+	keys, err := c.state.client.SMembers(ctx, index).Result()
+	if err != nil {
+		logSharedCacheError("remove", err)
+		return
+	}
+	if err := c.state.client.Del(ctx, append(keys, index)...).Err(); err != nil {
+		logSharedCacheError("remove", err)
+	}
+}
+
+// Reset only clears the local cache; shared entries belong to every replica.
+func (c *redisSegmentCache) Reset() {
+	c.local.Reset()
+}
+
+// Usage reports the local cache only; redis is shared and its contents expire on their own.
+func (c *redisSegmentCache) Usage() map[string]Occupancy {
+	return c.local.Usage()
+}
+
+func (c *redisSegmentCache) Stats() CacheStats {
+	stats := c.local.Stats()
+	// local misses that redis answered are not misses of the cache as a whole
+	stats.Hits += c.hits.Load()
+	stats.Misses = c.misses.Load()
+	return stats
+}
@@ -0,0 +1,67 @@
+package hls
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisSharedStateAgreesAcrossReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	require.NoError(t, ConfigureSharedState(&model.Config{
+		StateBackend:         "redis",
+		RedisURL:             "redis://" + server.Addr(),
+		RedisPrefix:          "test",
+		RedisSegmentMaxBytes: 4,
+		PlaylistRetention:    time.Hour,
+		ClipRetention:        time.Hour,
+	}))
+	t.Cleanup(func() { _ = ConfigureSharedState(&model.Config{}) })
+
+	segments := func(clips ...string) []*manifestSegment {
+		entries := make([]*manifestSegment, len(clips))
+		for i, clip := range clips {
+			entries[i] = &manifestSegment{ClipURL: clip}
+		}
+		return entries
+	}
+
+	// two replicas see overlapping windows of the same live playlist
+	first := &manifestHistory{key: "live", segments: make(map[string]*manifestSegment)}
+	second := &manifestHistory{key: "live", segments: make(map[string]*manifestSegment)}
+	first.merge(segments("a.ts", "b.ts", "c.ts"), 0)
+	merged := second.merge(segments("b.ts", "c.ts", "d.ts"), 0)
+
+	sequences := make([]int, len(merged))
+	for i, entry := range merged {
+		sequences[i] = entry.Sequence
+	}
+	assert.Equal(t, []int{1, 2, 3}, sequences)
+
+	shared := currentSharedState()
+	id, err := shared.PlaylistID("live", "first")
+	require.NoError(t, err)
+	assert.Equal(t, "first", id)
+	id, err = shared.PlaylistID("live", "second")
+	require.NoError(t, err)
+	assert.Equal(t, "first", id)
+
+	cacheA := currentSharedCache().over(newMemorySegmentCache(0))
+	cacheB := currentSharedCache().over(newMemorySegmentCache(0))
+	cacheA.Save("live", "a.ts", []byte("tiny"))
+	cacheA.Save("live", "b.ts", []byte("too large"))
+
+	data, ok := cacheB.Load("live", "a.ts")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("tiny"), data)
+	_, ok = cacheB.Load("live", "b.ts")
+	assert.False(t, ok)
+
+	cacheA.Remove("live")
+	_, ok = currentSharedCache().over(newMemorySegmentCache(0)).Load("live", "a.ts")
+	assert.False(t, ok)
+}
@@ -1,21 +1,98 @@
 package http_retry
 
 import (
-	"crypto/tls"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/upstream"
 )
 
 // DefaultHttpClient is the default http client used by the proxy
 // Timeout values can be overridden via environment variables; see config package defaults
 var DefaultHttpClient = http.Client{
-	Timeout: config.Settings.HTTPClientTimeout,
-	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		Dial: (&net.Dialer{
-			Timeout: config.Settings.HTTPDialTimeout,
-		}).Dial,
-	},
+	Timeout:   config.Settings.HTTPClientTimeout,
+	Transport: policyTransport{next: &hostTransports{}},
+}
+
+var dialer = &net.Dialer{
+	Timeout: config.Settings.HTTPDialTimeout,
+	// checks the address actually dialled, so a name re-resolving elsewhere is caught too
+	Control: upstream.Control,
+}
+
+// proxyDialer connects to configured egress proxies, which may well be on a private network.
+var proxyDialer = &net.Dialer{
+	Timeout: config.Settings.HTTPDialTimeout,
+}
+
+// policyTransport refuses requests, redirects included, to hosts the upstream policy blocks.
+type policyTransport struct {
+	next http.RoundTripper
+}
+
+func (t policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := upstream.CheckHost(req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// hostTransports gives every egress proxy and set of upstream TLS settings its own transport,
+// so a connection set up with one host's client certificate or verification settings, or
+// through one egress, is never reused for another.
+type hostTransports struct {
+	mu         sync.Mutex
+	rules      *upstream.TLSRules
+	proxies    *upstream.ProxyRules
+	transports map[string]*http.Transport
+}
+
+func (t *hostTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	proxies := upstream.CurrentProxies()
+	egress, err := proxies.For(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+	if egress != nil {
+		// the proxy makes the connection, so the dialer never sees the origin's address
+		if err := upstream.CheckLookup(req.Context(), host); err != nil {
+			return nil, err
+		}
+	}
+	return t.transportFor(host, proxies, egress).RoundTrip(req)
+}
+
+func (t *hostTransports) transportFor(host string, proxies *upstream.ProxyRules, egress *upstream.Egress) *http.Transport {
+	rules := upstream.CurrentTLS()
+	key, tlsConfig := rules.ForHost(host)
+	if egress != nil {
+		key += " via " + egress.URL.String()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rules != rules || t.proxies != proxies {
+		for _, transport := range t.transports {
+			transport.CloseIdleConnections()
+		}
+		t.rules = rules
+		t.proxies = proxies
+		t.transports = make(map[string]*http.Transport)
+	}
+	transport, ok := t.transports[key]
+	if !ok {
+		transport = &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Dial:            dialer.Dial,
+		}
+		if egress != nil {
+			transport.Proxy = http.ProxyURL(egress.URL)
+			transport.Dial = proxyDialer.Dial
+		}
+		t.transports[key] = transport
+	}
+	return transport
 }
@@ -0,0 +1,40 @@
+package http_retry
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/model"
+)
+
+// SetBaseHeaders gives an upstream request the Referer, Origin, User-Agent, headers and
+// cookies of the stream it belongs to, so prefetches and background fetches look like the
+// player's own requests. Headers named explicitly in the input win over the others.
+func SetBaseHeaders(req *http.Request, input *model.Input) {
+	req.Header.Set("User-Agent", config.Settings.UserAgent)
+	if input == nil {
+		return
+	}
+	if input.Referer != "" {
+		req.Header.Set("Referer", input.Referer)
+	}
+	if input.Origin != "" {
+		req.Header.Set("Origin", input.Origin)
+	}
+	if input.UserAgent != "" {
+		req.Header.Set("User-Agent", input.UserAgent)
+	}
+	for name, value := range input.Headers {
+		req.Header.Set(name, value)
+	}
+
+	names := make([]string, 0, len(input.Cookies))
+	for name := range input.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req.AddCookie(&http.Cookie{Name: name, Value: input.Cookies[name]})
+	}
+}
@@ -7,7 +7,12 @@ import (
 
 	"github.com/avast/retry-go"
 	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/metrics"
+	"github.com/bariiss/hls-proxy/tracing"
+	"github.com/bariiss/hls-proxy/upstream"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 /*
@@ -18,29 +23,44 @@ import (
 func ExecuteRetryableRequest(request *http.Request, attempts int) (*http.Response, error) {
 	request.Close = true
 	var resp *http.Response
+	attempt := 0
 	err := retry.Do(
 		func() error {
+			attempt++
+			req, span := startAttempt(request, attempt)
+			defer span.End()
+
 			var err error
-			resp, err = DefaultHttpClient.Do(request)
+			resp, err = DefaultHttpClient.Do(req)
 			if err != nil {
+				tracing.Fail(span, err)
 				return err
 			}
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+			if resp.StatusCode == http.StatusNotModified && isConditional(request) {
+				return nil
+			}
 
 			if valid := statusOK(resp.StatusCode); !valid {
 				log.WithField("status", resp.StatusCode).Warn("non 2xx status code")
-				return errors.New("non 2xx status code")
+				err := errors.New("non 2xx status code")
+				tracing.Fail(span, err)
+				return err
 			}
 
 			return nil
 		},
 		retry.Attempts(uint(attempts)),
 		retry.Delay(config.Settings.RetryRequestDelay),
+		retry.RetryIf(retryable),
 		retry.OnRetry(func(n uint, err error) {
+			metrics.UpstreamRetries.WithLabelValues("request").Inc()
 			log.Error("Retrying request after error:", err, n)
 		}),
 	)
 	if err != nil {
-		return nil, err
+		return nil, refusedOr(err)
 	}
 
 	return resp, nil
@@ -49,42 +69,84 @@ func ExecuteRetryableRequest(request *http.Request, attempts int) (*http.Respons
 func ExecuteRetryClipRequest(request *http.Request, attempts int) ([]byte, error) {
 	request.Close = true
 	var responseBytes []byte
+	attempt := 0
 	err := retry.Do(
 		func() error {
-			resp, err := DefaultHttpClient.Do(request)
+			attempt++
+			req, span := startAttempt(request, attempt)
+			defer span.End()
+
+			resp, err := DefaultHttpClient.Do(req)
 			if err != nil {
+				tracing.Fail(span, err)
 				return err
 			}
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 
 			if !statusOK(resp.StatusCode) {
-				return errors.New("non 2xx status code")
+				err := errors.New("non 2xx status code")
+				tracing.Fail(span, err)
+				return err
 			}
 
 			bytes, err := readResponse(resp)
 			if err != nil {
+				tracing.Fail(span, err)
 				return err
 			}
+			span.SetAttributes(attribute.Int("http.response.body.size", len(bytes)))
 
 			responseBytes = bytes
 			return nil
 		},
 		retry.Attempts(uint(attempts)),
 		retry.Delay(config.Settings.RetryClipDelay),
+		retry.RetryIf(retryable),
 		retry.OnRetry(func(n uint, err error) {
+			metrics.UpstreamRetries.WithLabelValues("clip").Inc()
 			log.Error("Retrying request after error:", err, n)
 		}),
 	)
 	if err != nil {
-		return nil, err
+		return nil, refusedOr(err)
 	}
 
 	return responseBytes, nil
 }
 
+// startAttempt opens the span for one try of a request; the origin sees it as the parent.
+func startAttempt(request *http.Request, attempt int) (*http.Request, trace.Span) {
+	return tracing.StartClient(request, "http_retry attempt", attribute.Int("http_retry.attempt", attempt))
+}
+
+// retryable stops retrying requests the upstream policy refused, or naming an unknown proxy;
+// they would only fail again.
+func retryable(err error) bool {
+	return !errors.Is(err, upstream.ErrBlocked) && !errors.Is(err, upstream.ErrUnknownProxy)
+}
+
+// refusedOr digs a policy refusal or unknown proxy out of the retry error list so callers can
+// tell it apart, and returns err as it is otherwise.
+func refusedOr(err error) error {
+	var attempts retry.Error
+	if errors.As(err, &attempts) {
+		for _, attemptErr := range attempts {
+			if !retryable(attemptErr) {
+				return attemptErr
+			}
+		}
+	}
+	return err
+}
+
 func statusOK(status int) bool {
 	return status >= 200 && status < 300
 }
 
+func isConditional(request *http.Request) bool {
+	return request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Modified-Since") != ""
+}
+
 func readResponse(resp *http.Response) ([]byte, error) {
 	defer resp.Body.Close()
 	return io.ReadAll(resp.Body)
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "hls_proxy"
+
+// Registry holds every metric served on /metrics. Values that already live elsewhere, such
+// as cache occupancy, are registered here as collectors that read them at scrape time.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	RequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to answer requests, by route and status.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "status"})
+
+	UpstreamBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_bytes_total",
+		Help:      "Bytes downloaded from origins while answering requests, by route.",
+	}, []string{"route"})
+
+	UpstreamRetries = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Origin requests retried after an error, by kind of request.",
+	}, []string{"kind"})
+
+	PrefetchClips = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "prefetch_clips_total",
+		Help:      "Prefetch jobs by result: fetched, joined an in-flight fetch, or failed.",
+	}, []string{"result"})
+
+	JanitorRuns = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_runs_total",
+		Help:      "Cleanup passes, by janitor.",
+	}, []string{"janitor"})
+
+	ManifestsPurged = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "manifests_purged_total",
+		Help:      "Manifests dropped by the inactivity janitor or the admin API.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ObserveRequest records one answered request.
+func ObserveRequest(route, method string, status int, latency time.Duration, bytesUpstream int64) {
+	code := strconv.Itoa(status)
+	Requests.WithLabelValues(route, methodLabel(method), code).Inc()
+	RequestDuration.WithLabelValues(route, code).Observe(latency.Seconds())
+	if bytesUpstream > 0 {
+		UpstreamBytes.WithLabelValues(route).Add(float64(bytesUpstream))
+	}
+}
+
+// methodLabel keeps the method label to the standard methods, since clients can send any
+// token as a method and each one would add a series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownMethodsShareOneLabel(t *testing.T) {
+	ObserveRequest("/test", "GET", 200, time.Millisecond, 0)
+	ObserveRequest("/test", "BREW", 400, time.Millisecond, 0)
+	ObserveRequest("/test", "get", 400, time.Millisecond, 0)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(Requests.WithLabelValues("/test", "GET", "200")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(Requests.WithLabelValues("/test", "other", "400")))
+	assert.Equal(t, 2, testutil.CollectAndCount(Requests))
+}
@@ -1,6 +1,10 @@
 package model
 
-import "time"
+import (
+	"net/url"
+	"strings"
+	"time"
+)
 
 var (
 	Configuration Config
@@ -10,12 +14,32 @@ type Config struct {
 	Prefetch                   bool
 	SegmentCount               int
 	SegmentCache               bool
+	SegmentCacheMaxBytes       int64
 	SegmentStore               bool
 	SegmentStorageDir          string
+	SegmentStorePersist        bool
+	SegmentStoreMaxBytes       int64
+	SegmentStoreMinFreeBytes   int64
+	SegmentStoreBackend        string
+	S3Endpoint                 string
+	S3Bucket                   string
+	S3Prefix                   string
+	S3Region                   string
+	S3AccessKey                string
+	S3SecretKey                string
+	S3SessionToken             string
+	S3PathStyle                bool
+	StateBackend               string
+	RedisURL                   string
+	RedisPrefix                string
+	RedisSegmentMaxBytes       int64
 	SegmentIdleEnabled         bool
 	SegmentIdleTimeout         time.Duration
 	SegmentIdleRequireSegments bool
 	SegmentBackgroundFetch     bool
+	ManifestPoll               bool
+	ManifestCacheFraction      float64
+	ManifestCacheStaticTTL     time.Duration
 	Throttle                   int
 	Attempts                   int
 	ClipRetention              time.Duration
@@ -27,18 +51,59 @@ type Config struct {
 	Port                       string
 	LogLevel                   string
 	Healthcheck                bool
+	RecordingDir               string
+	StreamRegistryDir          string
+	Metrics                    bool
+	TracingEndpoint            string
+	TracingSampleRatio         float64
+	TracingPropagate           bool
+	URLSigningSecret           string
+	URLSigningTTL              time.Duration
+	InputTokenKeys             string
+	InputTokenGrace            time.Duration
+	InputTokenRequireEncrypted bool
+	UpstreamAllow              string
+	UpstreamDeny               string
+	UpstreamAllowPrivate       bool
+	UpstreamTLSInsecure        string
+	UpstreamCABundle           string
+	UpstreamClientCerts        string
+	UpstreamProxy              string
+	UpstreamProxies            string
+	UpstreamProxyRules         string
+	AdminToken                 string
 }
 
 type ConfigInit struct {
 	Prefetch                   bool
 	SegmentCount               int
 	SegmentCache               bool
+	SegmentCacheMaxBytes       int64
 	SegmentStore               bool
 	SegmentStorageDir          string
+	SegmentStorePersist        bool
+	SegmentStoreMaxBytes       int64
+	SegmentStoreMinFreeBytes   int64
+	SegmentStoreBackend        string
+	S3Endpoint                 string
+	S3Bucket                   string
+	S3Prefix                   string
+	S3Region                   string
+	S3AccessKey                string
+	S3SecretKey                string
+	S3SessionToken             string
+	S3PathStyle                bool
+	StateBackend               string
+	RedisURL                   string
+	RedisPrefix                string
+	RedisSegmentMaxBytes       int64
 	SegmentIdleEnabled         bool
 	SegmentIdleTimeout         time.Duration
 	SegmentIdleRequireSegments bool
 	SegmentBackgroundFetch     bool
+	ManifestPoll               bool
+	ManifestCacheFraction      float64
+	ManifestCacheStaticTTL     time.Duration
 	Throttle                   int
 	Attempts                   int
 	ClipRetention              time.Duration
@@ -50,8 +115,63 @@ type ConfigInit struct {
 	Port                       string
 	LogLevel                   string
 	Healthcheck                bool
+	RecordingDir               string
+	StreamRegistryDir          string
+	Metrics                    bool
+	TracingEndpoint            string
+	TracingSampleRatio         float64
+	TracingPropagate           bool
+	URLSigningSecret           string
+	URLSigningTTL              time.Duration
+	InputTokenKeys             string
+	InputTokenGrace            time.Duration
+	InputTokenRequireEncrypted bool
+	UpstreamAllow              string
+	UpstreamDeny               string
+	UpstreamAllowPrivate       bool
+	UpstreamTLSInsecure        string
+	UpstreamCABundle           string
+	UpstreamClientCerts        string
+	UpstreamProxy              string
+	UpstreamProxies            string
+	UpstreamProxyRules         string
+	AdminToken                 string
 }
 
 func InitializeConfig(opts ConfigInit) {
 	Configuration = Config(opts)
 }
+
+// Redacted returns a copy of the configuration that is safe to log.
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.S3AccessKey, &c.S3SecretKey, &c.S3SessionToken, &c.AdminToken, &c.URLSigningSecret, &c.InputTokenKeys} {
+		if *secret != "" {
+			*secret = "xxxxx"
+		}
+	}
+	if parsed, err := url.Parse(c.RedisURL); err == nil {
+		c.RedisURL = parsed.Redacted()
+	}
+	c.UpstreamProxy = redactProxies(c.UpstreamProxy)
+	c.UpstreamProxies = redactProxies(c.UpstreamProxies)
+	c.UpstreamProxyRules = redactProxies(c.UpstreamProxyRules)
+	return c
+}
+
+// redactProxies hides proxy passwords in a comma separated list of proxy URLs, or of
+// "key=url" entries.
+func redactProxies(value string) string {
+	entries := strings.Split(value, ",")
+	for i, entry := range entries {
+		key, proxyURL, found := strings.Cut(entry, "=")
+		if found && !strings.Contains(key, "://") {
+			key += "="
+		} else {
+			key, proxyURL = "", entry
+		}
+		if parsed, err := url.Parse(strings.TrimSpace(proxyURL)); err == nil && parsed.User != nil {
+			entries[i] = key + parsed.Redacted()
+		}
+	}
+	return strings.Join(entries, ",")
+}
@@ -6,4 +6,14 @@ type Input struct {
 	Referer string
 	Origin  string
 	Encoded string
+	// UserAgent replaces the configured User-Agent for this stream's upstream requests
+	UserAgent string
+	// Headers and Cookies are sent with every upstream request for the stream
+	Headers map[string]string
+	Cookies map[string]string
+	// StreamID is set for streams served from the registry, whose child URLs are short
+	// per-stream paths instead of tokens
+	StreamID string
+	// Proxy names the configured egress proxy the stream's upstream requests go through
+	Proxy string
 }
@@ -0,0 +1,204 @@
+package parsing
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+)
+
+/*
+Encrypted input tokens hide the origin URL and headers from players. A token is
+tokenPrefix followed by the unpadded URL-safe base64 of
+
+	version (1) | key id (4) | issued at, unix seconds (8) | nonce (12) | AES-GCM ciphertext
+
+where the ciphertext seals the same "url|referer|origin" or JSON payload a plain base64
+input carries, and the header is authenticated as additional data. The key id is how
+tokens minted under a retired key are told apart.
+
+Sealing is deterministic, so a playlist refresh hands players the same URLs: the nonce is
+an HMAC of the header and payload, and the issue time is rounded down to
+tokenIssueGranularity. Tokens under a retired key may therefore lapse up to that much
+before the grace period ends.
+*/
+const (
+	tokenPrefix           = "e1."
+	tokenVersion          = 1
+	tokenHeader           = 1 + 4 + 8
+	tokenIssueGranularity = time.Hour
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid input token")
+	ErrUnknownKey   = errors.New("input token was encrypted with an unknown key")
+	ErrRetiredKey   = errors.New("input token was encrypted with a retired key")
+	ErrPlainToken   = errors.New("input token is not encrypted")
+)
+
+type tokenKey struct {
+	id       [4]byte
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+var (
+	tokenMu       sync.RWMutex
+	tokenKeys     []tokenKey
+	tokenGrace    time.Duration
+	tokenRequired bool
+)
+
+/*
+ConfigureTokenKeys turns on encrypted input tokens. The first key encrypts new tokens; the
+others only decrypt, and only tokens issued less than grace ago, so a rotated-out key stops
+working once players have moved on to URLs minted under the new one. No keys turns
+encryption off.
+*/
+func ConfigureTokenKeys(secrets []string, grace time.Duration) error {
+	keys := make([]tokenKey, 0, len(secrets))
+	for _, secret := range secrets {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		// keys of any length become AES-256 keys
+		material := sha256.Sum256([]byte(secret))
+		block, err := aes.NewCipher(material[:])
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		fingerprint := sha256.Sum256(material[:])
+		nonceKey := sha256.Sum256(append([]byte("nonce\x00"), material[:]...))
+		key := tokenKey{aead: aead, nonceKey: nonceKey[:]}
+		copy(key.id[:], fingerprint[:4])
+		keys = append(keys, key)
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	tokenKeys = keys
+	tokenGrace = grace
+	return nil
+}
+
+// RequireEncryptedTokens makes ParseInputUrl refuse plain base64 tokens while keys are
+// configured, so only URLs the proxy or "hls-proxy sign" minted are served.
+func RequireEncryptedTokens(required bool) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	tokenRequired = required
+}
+
+// plainTokensRefused reports whether plain base64 tokens are refused.
+func plainTokensRefused() bool {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return tokenRequired && len(tokenKeys) > 0
+}
+
+// TokensEncrypted reports whether EncodeToken emits encrypted tokens.
+func TokensEncrypted() bool {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return len(tokenKeys) > 0
+}
+
+// EncodeToken returns the token a proxy URL carries for input: encrypted when keys are
+// configured, unpadded URL-safe base64 otherwise.
+func EncodeToken(input *model.Input) string {
+	payload := EncodeInput(input)
+	if !TokensEncrypted() {
+		return base64.RawURLEncoding.EncodeToString([]byte(payload))
+	}
+	return sealToken([]byte(payload))
+}
+
+// SealValue encrypts another value a proxy URL carries, such as the playlist ID, when input
+// tokens are encrypted, and returns it unchanged otherwise.
+func SealValue(value string) string {
+	if value == "" || !TokensEncrypted() {
+		return value
+	}
+	return sealToken([]byte(value))
+}
+
+// OpenValue reverses SealValue. Values that were not encrypted are returned as they are.
+func OpenValue(value string) (string, error) {
+	if !isEncryptedToken(value) {
+		return value, nil
+	}
+	payload, err := decryptToken(value)
+	return string(payload), err
+}
+
+func sealToken(payload []byte) string {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	if len(tokenKeys) == 0 {
+		return base64.RawURLEncoding.EncodeToString(payload)
+	}
+	key := tokenKeys[0]
+	sealed := make([]byte, tokenHeader, tokenHeader+key.aead.NonceSize()+len(payload)+key.aead.Overhead())
+	sealed[0] = tokenVersion
+	copy(sealed[1:5], key.id[:])
+	binary.BigEndian.PutUint64(sealed[5:tokenHeader], uint64(time.Now().Truncate(tokenIssueGranularity).Unix()))
+	// a nonce only repeats for the same header and payload, which then seal to the same token
+	mac := hmac.New(sha256.New, key.nonceKey)
+	mac.Write(sealed[:tokenHeader])
+	mac.Write(payload)
+	nonce := mac.Sum(nil)[:key.aead.NonceSize()]
+	sealed = append(sealed, nonce...)
+	sealed = key.aead.Seal(sealed, nonce, []byte(payload), sealed[:tokenHeader])
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func isEncryptedToken(s string) bool {
+	return strings.HasPrefix(s, tokenPrefix)
+}
+
+// decryptToken opens an encrypted token and returns the payload it seals.
+func decryptToken(token string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, tokenPrefix))
+	if err != nil || len(sealed) < tokenHeader || sealed[0] != tokenVersion {
+		return nil, ErrInvalidToken
+	}
+
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	for i, key := range tokenKeys {
+		if !bytes.Equal(sealed[1:5], key.id[:]) {
+			continue
+		}
+		nonceSize := key.aead.NonceSize()
+		if len(sealed) < tokenHeader+nonceSize {
+			return nil, ErrInvalidToken
+		}
+		nonce := sealed[tokenHeader : tokenHeader+nonceSize]
+		payload, err := key.aead.Open(nil, nonce, sealed[tokenHeader+nonceSize:], sealed[:tokenHeader])
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		if i > 0 {
+			issued := time.Unix(int64(binary.BigEndian.Uint64(sealed[5:tokenHeader])), 0)
+			if time.Since(issued) > tokenGrace {
+				return nil, ErrRetiredKey
+			}
+		}
+		return payload, nil
+	}
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,86 @@
+package parsing
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedTokenRoundTrips(t *testing.T) {
+	require.NoError(t, ConfigureTokenKeys([]string{"current"}, time.Hour))
+	defer ConfigureTokenKeys(nil, 0)
+
+	input := &model.Input{Url: "https://origin.example/live.m3u8", Referer: "https://player.example"}
+	token := EncodeToken(input)
+	assert.False(t, strings.Contains(token, "origin.example"))
+
+	r, err := ParseInputUrl(token)
+	require.NoError(t, err)
+	assert.Equal(t, input.Url, r.Url)
+	assert.Equal(t, input.Referer, r.Referer)
+	// the stream keeps the identity a plain base64 input would give it
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("https://origin.example/live.m3u8|https://player.example")), r.Encoded)
+
+	_, err = ParseInputUrl(token[:len(token)-2] + "AA")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestEncryptedTokenKeyRotation(t *testing.T) {
+	defer ConfigureTokenKeys(nil, 0)
+	require.NoError(t, ConfigureTokenKeys([]string{"old"}, time.Hour))
+	token := EncodeToken(&model.Input{Url: "https://origin.example/live.m3u8"})
+
+	// rotated: tokens under the old key work during the grace period
+	require.NoError(t, ConfigureTokenKeys([]string{"new", "old"}, time.Hour))
+	_, err := ParseInputUrl(token)
+	assert.NoError(t, err)
+
+	require.NoError(t, ConfigureTokenKeys([]string{"new", "old"}, -time.Second))
+	_, err = ParseInputUrl(token)
+	assert.ErrorIs(t, err, ErrRetiredKey)
+
+	require.NoError(t, ConfigureTokenKeys([]string{"new"}, time.Hour))
+	_, err = ParseInputUrl(token)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestEncryptedTokensAreStableAcrossRefreshes(t *testing.T) {
+	require.NoError(t, ConfigureTokenKeys([]string{"current"}, time.Hour))
+	defer ConfigureTokenKeys(nil, 0)
+
+	input := &model.Input{Url: "https://origin.example/live/1.ts", Referer: "https://player.example"}
+	assert.Equal(t, EncodeToken(input), EncodeToken(input))
+	assert.Equal(t, SealValue("playlist"), SealValue("playlist"))
+	assert.NotEqual(t, EncodeToken(input), EncodeToken(&model.Input{Url: "https://origin.example/live/2.ts"}))
+
+	// another key seals the same value to an unrelated token
+	sealed := SealValue("playlist")
+	require.NoError(t, ConfigureTokenKeys([]string{"other"}, time.Hour))
+	assert.NotEqual(t, sealed, SealValue("playlist"))
+}
+
+func TestPlainTokensCanBeRefused(t *testing.T) {
+	defer ConfigureTokenKeys(nil, 0)
+	defer RequireEncryptedTokens(false)
+	plain := base64.RawURLEncoding.EncodeToString([]byte("https://origin.example/live.m3u8"))
+
+	// without keys there is nothing else to accept
+	RequireEncryptedTokens(true)
+	_, err := ParseInputUrl(plain)
+	require.NoError(t, err)
+
+	require.NoError(t, ConfigureTokenKeys([]string{"current"}, time.Hour))
+	_, err = ParseInputUrl(plain)
+	assert.ErrorIs(t, err, ErrPlainToken)
+	_, _, err = ParseProxyPath(plain + "/live.m3u8")
+	assert.ErrorIs(t, err, ErrPlainToken)
+
+	r, err := ParseInputUrl(EncodeToken(&model.Input{Url: "https://origin.example/live.m3u8"}))
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example/live.m3u8", r.Url)
+}
@@ -2,23 +2,79 @@ package parsing
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
+	"path"
 	"strings"
 
 	"github.com/bariiss/hls-proxy/model"
 )
 
-func ParseInputUrl(inputString string) (*model.Input, error) {
+// inputPayloadVersion is the current version of the JSON input format.
+const inputPayloadVersion = 1
+
+/*
+inputPayload is the JSON form of an input, for streams that need more than a Referer and
+Origin. It is base64 encoded like the legacy "url|referer|origin" form:
+
+	{"v":1,"url":"https://example.com/live.m3u8","user_agent":"...","headers":{"Authorization":"Bearer x"},"cookies":{"session":"abc"}}
+*/
+type inputPayload struct {
+	Version   int               `json:"v"`
+	Url       string            `json:"url"`
+	Referer   string            `json:"referer,omitempty"`
+	Origin    string            `json:"origin,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Cookies   map[string]string `json:"cookies,omitempty"`
+	Proxy     string            `json:"proxy,omitempty"`
+}
+
+// NormalizeToken strips what players and the proxy add around an input token.
+func NormalizeToken(inputString string) string {
 	// normalize input: trim whitespace, strip common proxy suffixes
 	s := strings.TrimSpace(inputString)
 	// strip trailing .ts if present (proxy appends this after the encoded string)
 	s = strings.TrimSuffix(s, ".ts")
 	// strip any trailing slash
-	s = strings.TrimRight(s, "/")
+	return strings.TrimRight(s, "/")
+}
 
-	decodedBytes, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return nil, errors.New("invalid base64 input")
+/*
+ParseInputUrl decodes a base64 or encrypted input token. Standard and URL-safe base64 are
+accepted, padded or not, unless RequireEncryptedTokens refuses them. Encoded is always the
+padded standard form, so a stream keeps one identity however its URLs were encoded.
+*/
+func ParseInputUrl(inputString string) (*model.Input, error) {
+	s := NormalizeToken(inputString)
+
+	var decodedBytes []byte
+	var err error
+	if isEncryptedToken(s) {
+		decodedBytes, err = decryptToken(s)
+		if err != nil {
+			return nil, err
+		}
+		s = base64.StdEncoding.EncodeToString(decodedBytes)
+	} else if plainTokensRefused() {
+		return nil, ErrPlainToken
+	} else {
+		decodedBytes, err = decodeBase64(s)
+		if err != nil {
+			return nil, errors.New("invalid base64 input")
+		}
+		s = base64.StdEncoding.EncodeToString(decodedBytes)
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(string(decodedBytes)), "{") {
+		out, err := parseInputPayload(decodedBytes)
+		if err != nil {
+			return nil, err
+		}
+		out.Encoded = s
+		return out, nil
 	}
 
 	parts := strings.Split(string(decodedBytes), "|")
@@ -44,3 +100,146 @@ func ParseInputUrl(inputString string) (*model.Input, error) {
 
 	return out, nil
 }
+
+/*
+ParseProxyPath decodes the path of a proxy URL and returns the input along with the token
+it carried, which is what URL signatures cover. Two shapes are accepted:
+
+	/<token>/<file name>   what rewritten playlists emit; the name is the origin URL's file
+	                       name, only there for players and CDNs that go by the extension
+	/<token>               older URLs, including standard base64 with "/" in it and an
+	                       optional ".ts" suffix
+
+A legacy token can end in something that looks like a file name, so the name has to match
+the decoded URL before the shorter token wins; other names are tried last.
+*/
+func ParseProxyPath(p string) (*model.Input, string, error) {
+	p = strings.TrimPrefix(strings.TrimSpace(p), "/")
+	dir, name, found := cutLast(p, "/")
+	pathStyle := found && strings.Contains(name, ".")
+
+	var named *model.Input
+	var namedToken string
+	if pathStyle {
+		namedToken = NormalizeToken(dir)
+		input, err := ParseInputUrl(namedToken)
+		if isEncryptedToken(namedToken) {
+			return input, namedToken, err
+		}
+		if err == nil && isAbsoluteURL(input.Url) {
+			if fileName(input.Url) == name {
+				return input, namedToken, nil
+			}
+			named = input
+		}
+	}
+
+	token := NormalizeToken(p)
+	input, err := ParseInputUrl(token)
+	if err != nil && named != nil {
+		return named, namedToken, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return input, token, nil
+}
+
+/*
+TokenPath is the proxy path for token pointing at target: the token followed by target's
+file name, when it has an extension worth showing.
+*/
+func TokenPath(token, target string) string {
+	name := fileName(target)
+	if path.Ext(name) == "" {
+		return token
+	}
+	return token + "/" + url.PathEscape(name)
+}
+
+// fileName is the last element of target's path, or "" when it has none.
+func fileName(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(parsed.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// decodeBase64 accepts standard and URL-safe base64, with or without padding, but not both
+// alphabets in one token.
+func decodeBase64(s string) ([]byte, error) {
+	if strings.ContainsAny(s, "-_") && strings.ContainsAny(s, "+/") {
+		return nil, errors.New("mixed base64 alphabets")
+	}
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func isAbsoluteURL(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+func parseInputPayload(data []byte) (*model.Input, error) {
+	var payload inputPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, errors.New("invalid JSON input")
+	}
+	if payload.Version != inputPayloadVersion {
+		return nil, fmt.Errorf("unsupported input version %d", payload.Version)
+	}
+	if strings.TrimSpace(payload.Url) == "" {
+		return nil, errors.New("empty input")
+	}
+	return &model.Input{
+		Url:       strings.TrimSpace(payload.Url),
+		Referer:   payload.Referer,
+		Origin:    payload.Origin,
+		UserAgent: payload.UserAgent,
+		Headers:   payload.Headers,
+		Cookies:   payload.Cookies,
+		Proxy:     payload.Proxy,
+	}, nil
+}
+
+// EncodeInput is the inverse of ParseInputUrl, without the base64 step. Inputs that fit the
+// legacy "url|referer|origin" form keep it, so rewritten URLs stay short.
+func EncodeInput(input *model.Input) string {
+	legacy := input.UserAgent == "" && len(input.Headers) == 0 && len(input.Cookies) == 0 && input.Proxy == "" &&
+		!strings.Contains(input.Url+input.Referer+input.Origin, "|")
+	if legacy {
+		encoded := input.Url
+		if input.Referer != "" || input.Origin != "" {
+			encoded += "|" + input.Referer
+		}
+		if input.Origin != "" {
+			encoded += "|" + input.Origin
+		}
+		return encoded
+	}
+
+	data, _ := json.Marshal(inputPayload{
+		Version:   inputPayloadVersion,
+		Url:       input.Url,
+		Referer:   input.Referer,
+		Origin:    input.Origin,
+		UserAgent: input.UserAgent,
+		Headers:   input.Headers,
+		Cookies:   input.Cookies,
+		Proxy:     input.Proxy,
+	})
+	return string(data)
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/base64"
 	"testing"
 
+	"github.com/bariiss/hls-proxy/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseInputUrl(t *testing.T) {
@@ -34,3 +36,63 @@ func TestParseInputUrl(t *testing.T) {
 	assert.Equal(t, "", r.Origin)
 
 }
+
+func TestParseInputUrlJSONPayload(t *testing.T) {
+	payload := `{"v":1,"url":"https://example.com/live.m3u8","user_agent":"Player/1.0","headers":{"Authorization":"Bearer x"},"cookies":{"session":"abc"}}`
+	r, err := ParseInputUrl(base64.StdEncoding.EncodeToString([]byte(payload)))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/live.m3u8", r.Url)
+	assert.Equal(t, "Player/1.0", r.UserAgent)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer x"}, r.Headers)
+	assert.Equal(t, map[string]string{"session": "abc"}, r.Cookies)
+
+	_, err = ParseInputUrl(base64.StdEncoding.EncodeToString([]byte(`{"v":2,"url":"a"}`)))
+	assert.Error(t, err)
+}
+
+func TestEncodeInputRoundTrips(t *testing.T) {
+	inputs := []*model.Input{
+		{Url: "a", Referer: "b", Origin: "c"},
+		{Url: "a", Origin: "c"},
+		{Url: "a", Headers: map[string]string{"X-Token": "t"}, Cookies: map[string]string{"s": "1"}},
+		{Url: "a", Referer: "b", Proxy: "geo-de"},
+	}
+	for _, input := range inputs {
+		encoded := base64.StdEncoding.EncodeToString([]byte(EncodeInput(input)))
+		r, err := ParseInputUrl(encoded)
+		assert.NoError(t, err)
+		input.Encoded = encoded
+		assert.Equal(t, input, r)
+	}
+	assert.Equal(t, "a|b|c", EncodeInput(inputs[0]))
+}
+
+func TestParseProxyPathAcceptsEveryEncoding(t *testing.T) {
+	// "?>" makes the standard encoding contain "/" and the URL-safe one "_"
+	payload := []byte("https://origin.example/live.m3u8?>|https://player.example")
+	canonical := base64.StdEncoding.EncodeToString(payload)
+	require.Contains(t, canonical, "/")
+
+	paths := []string{
+		canonical,
+		canonical + ".ts",
+		base64.RawStdEncoding.EncodeToString(payload),
+		base64.URLEncoding.EncodeToString(payload),
+		base64.RawURLEncoding.EncodeToString(payload),
+		TokenPath(base64.RawURLEncoding.EncodeToString(payload), "https://origin.example/live.m3u8?x=1"),
+	}
+	for _, p := range paths {
+		r, _, err := ParseProxyPath(p)
+		require.NoError(t, err, p)
+		assert.Equal(t, "https://origin.example/live.m3u8?>", r.Url)
+		assert.Equal(t, "https://player.example", r.Referer)
+		assert.Equal(t, canonical, r.Encoded)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(payload)
+	assert.Equal(t, token+"/live.m3u8", TokenPath(token, "https://origin.example/live.m3u8?x=1"))
+	assert.Equal(t, token, TokenPath(token, "https://origin.example/chunk?id=3"))
+	_, signed, err := ParseProxyPath(token + "/segment.ts")
+	require.NoError(t, err)
+	assert.Equal(t, token, signed)
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import "github.com/bariiss/hls-proxy/hls"
+
+// Overview summarises what the proxy holds, for the admin API.
+type Overview struct {
+	Manifests        int                 `json:"manifests"`
+	LivePollers      int                 `json:"live_pollers"`
+	PrefetchInFlight int                 `json:"prefetch_in_flight"`
+	Cache            hls.CacheStats      `json:"cache"`
+	Store            hls.StoreStats      `json:"store"`
+	Repository       hls.RepositoryStats `json:"repository"`
+}
+
+// Manifests lists the manifest histories with their cache and store occupancy.
+func Manifests() []hls.ManifestInfo {
+	return hls.ListManifests()
+}
+
+// PrefetchQueues lists the playlists the prefetcher holds clips for.
+func PrefetchQueues() []hls.PrefetchQueue {
+	return preFetcher.Queues()
+}
+
+// PurgeManifest drops one manifest, its cached playlist and everything held for its
+// segments. Its live poller, if any, stops on its next tick.
+func PurgeManifest(key string) bool {
+	manifests.forget(key)
+	return hls.PurgeManifest(preFetcher, key)
+}
+
+// PurgeAll drops every manifest and empties the segment cache and store.
+func PurgeAll() int {
+	manifests.reset()
+	return hls.PurgeAllManifests(preFetcher)
+}
+
+func GetOverview() Overview {
+	pollersMu.Lock()
+	livePollers := len(pollers)
+	pollersMu.Unlock()
+
+	return Overview{
+		Manifests:        len(hls.ListManifests()),
+		LivePollers:      livePollers,
+		PrefetchInFlight: preFetcher.InFlight(),
+		Cache:            hls.SegmentCacheStats(),
+		Store:            hls.SegmentStoreStats(),
+		Repository:       SegmentRepositoryStats(),
+	}
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	manifestEntryMaxAge = 5 * time.Minute
+	manifestSweepEvery  = time.Minute
+)
+
+// manifestEntry is an upstream playlist as last fetched from the origin. Entries are
+// replaced wholesale on refresh, so readers may share them without locking.
+type manifestEntry struct {
+	body         string
+	finalURL     url.URL
+	etag         string
+	lastModified string
+	fetchedAt    time.Time
+	ttl          time.Duration
+}
+
+func (e *manifestEntry) fresh(now time.Time) bool {
+	return e.ttl > 0 && now.Sub(e.fetchedAt) < e.ttl
+}
+
+// location returns a copy of the final upstream URL, since ModifyM3u8 rewrites its argument.
+func (e *manifestEntry) location() *url.URL {
+	u := e.finalURL
+	return &u
+}
+
+// manifestCache coalesces concurrent upstream fetches of the same playlist and serves the
+// last fetched copy for a fraction of its target duration, so origin load is per channel.
+type manifestCache struct {
+	mu        sync.Mutex
+	entries   map[string]*manifestEntry
+	lastSweep time.Time
+	group     singleflight.Group
+}
+
+var manifests = &manifestCache{entries: make(map[string]*manifestEntry)}
+
+// fetch returns the playlist for input, along with the number of bytes this call pulled
+// from the origin (zero when served from cache or by another caller's fetch). The origin
+// fetch is traced under ctx but outlives its cancellation, since other callers may join it.
+func (m *manifestCache) fetch(ctx context.Context, input *model.Input) (*manifestEntry, int64, error) {
+	key := manifestKey(input)
+	if entry := m.get(key); entry != nil && entry.fresh(time.Now()) {
+		return entry, 0, nil
+	}
+	return m.join(ctx, key, input, false)
+}
+
+// reload asks the origin for the playlist even when the cached copy is fresh, so a live
+// poller sees the origin's playlist rather than the one it fetched last time.
+func (m *manifestCache) reload(ctx context.Context, input *model.Input) (*manifestEntry, error) {
+	entry, _, err := m.join(ctx, manifestKey(input), input, true)
+	return entry, err
+}
+
+// join runs a refresh of key, or joins the one already in flight.
+func (m *manifestCache) join(ctx context.Context, key string, input *model.Input, force bool) (*manifestEntry, int64, error) {
+	// only the caller whose function runs counts the origin bytes; singleflight reports
+	// shared to that caller too when others joined
+	var upstream int64
+	result, err, _ := m.group.Do(key, func() (any, error) {
+		entry, n, err := m.refresh(context.WithoutCancel(ctx), key, input, force)
+		upstream = n
+		return entry, err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return result.(*manifestEntry), upstream, nil
+}
+
+func (m *manifestCache) refresh(ctx context.Context, key string, input *model.Input, force bool) (*manifestEntry, int64, error) {
+	previous := m.get(key)
+	if previous != nil && !force && previous.fresh(time.Now()) {
+		return previous, 0, nil
+	}
+	if previous == nil {
+		// VOD media playlists kept by a persistent segment store replay without the origin
+		if stored := loadStoredManifest(key); stored != nil && !hls.IsMasterPlaylist(stored.body) {
+			log.Debugf("Serving stored VOD playlist for %s", input.Url)
+			m.put(key, stored)
+			return stored, 0, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(upstream.WithProxy(ctx, input.Proxy), "GET", input.Url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	http_retry.SetBaseHeaders(req, input)
+	if previous != nil {
+		if previous.etag != "" {
+			req.Header.Set("If-None-Match", previous.etag)
+		}
+		if previous.lastModified != "" {
+			req.Header.Set("If-Modified-Since", previous.lastModified)
+		}
+	}
+
+	resp, err := http_retry.ExecuteRetryableRequest(req, 3)
+	if err != nil {
+		if stored := loadStoredManifest(key); stored != nil {
+			log.Warnf("Origin unavailable for %s, serving stored playlist: %v", input.Url, err)
+			m.put(key, stored)
+			return stored, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	if resp.StatusCode == http.StatusNotModified && previous != nil {
+		log.Debugf("Manifest %s not modified upstream", input.Url)
+		entry := *previous
+		entry.fetchedAt = now
+		m.put(key, &entry)
+		return &entry, 0, nil
+	}
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := string(bytes)
+	entry := &manifestEntry{
+		body:         body,
+		finalURL:     *resp.Request.URL,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		fetchedAt:    now,
+		ttl:          manifestTTL(body),
+	}
+	m.put(key, entry)
+
+	if hls.IsMasterPlaylist(body) || containsEndList(body) {
+		if err := hls.SavePlaylist(key, entry.finalURL.String(), bytes); err != nil {
+			log.Warnf("Failed to store playlist %s: %v", input.Url, err)
+		}
+	}
+	return entry, int64(len(bytes)), nil
+}
+
+func loadStoredManifest(key string) *manifestEntry {
+	body, sourceURL, ok, err := hls.LoadPlaylist(key)
+	if err != nil {
+		log.Warnf("Failed to load stored playlist %s: %v", key, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	location, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil
+	}
+	return &manifestEntry{
+		body:      string(body),
+		finalURL:  *location,
+		fetchedAt: time.Now(),
+		ttl:       manifestTTL(string(body)),
+	}
+}
+
+func (m *manifestCache) get(key string) *manifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[key]
+}
+
+func (m *manifestCache) put(key string, entry *manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = entry
+
+	now := entry.fetchedAt
+	if now.Sub(m.lastSweep) < manifestSweepEvery {
+		return
+	}
+	m.lastSweep = now
+	for k, existing := range m.entries {
+		if now.Sub(existing.fetchedAt) > manifestEntryMaxAge {
+			delete(m.entries, k)
+		}
+	}
+}
+
+func (m *manifestCache) forget(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+func (m *manifestCache) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = make(map[string]*manifestEntry)
+}
+
+// manifestTTL is the reuse window for a fetched playlist: a fraction of the target duration
+// for live media playlists and a fixed window for master and VOD playlists.
+func manifestTTL(body string) time.Duration {
+	if hls.IsMasterPlaylist(body) || containsEndList(body) {
+		return model.Configuration.ManifestCacheStaticTTL
+	}
+	fraction := model.Configuration.ManifestCacheFraction
+	if fraction <= 0 {
+		return 0
+	}
+	target := hls.ParseTargetDuration(body)
+	if target <= 0 {
+		return 0
+	}
+	return time.Duration(float64(target) * min(fraction, 1))
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	liveTestPlaylist   = "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:10.0,\nseg-0.ts\n"
+	vodTestPlaylist    = "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.0,\nseg-0.ts\n#EXT-X-ENDLIST\n"
+	masterTestPlaylist = "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\n720p.m3u8\n"
+)
+
+// useManifestCache points the manifest cache at loopback origins with a clean slate.
+func useManifestCache(t *testing.T) {
+	t.Helper()
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	previous := model.Configuration
+	previousDelay := config.Settings.RetryRequestDelay
+	model.Configuration.ManifestCacheFraction = 0.5
+	model.Configuration.ManifestCacheStaticTTL = time.Minute
+	config.Settings.RetryRequestDelay = time.Millisecond
+	manifests.reset()
+	t.Cleanup(func() {
+		upstream.Use(&upstream.Policy{})
+		model.Configuration = previous
+		config.Settings.RetryRequestDelay = previousDelay
+		manifests.reset()
+	})
+}
+
+// useStoredPlaylists enables a persistent segment store in a temporary directory.
+func useStoredPlaylists(t *testing.T) {
+	t.Helper()
+	require.NoError(t, hls.ConfigureSegmentStore(true, t.TempDir(), true))
+	t.Cleanup(func() { _ = hls.ConfigureSegmentStore(false, "", false) })
+}
+
+func TestManifestCacheCoalescesConcurrentFetches(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte(liveTestPlaylist))
+	}))
+	defer origin.Close()
+	useManifestCache(t)
+
+	input := &model.Input{Url: origin.URL + "/live.m3u8", Encoded: "coalesce-test"}
+	var wg sync.WaitGroup
+	var pulled atomic.Int64
+	bodies := make([]string, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, n, err := manifests.fetch(context.Background(), input)
+			if assert.NoError(t, err) {
+				bodies[i] = entry.body
+				pulled.Add(n)
+			}
+		}()
+	}
+	assert.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+	// give the other callers time to join the fetch in flight
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), requests.Load())
+	for _, body := range bodies {
+		assert.Equal(t, liveTestPlaylist, body)
+	}
+	// the origin bytes are counted once, against the caller that fetched them
+	assert.Equal(t, int64(len(liveTestPlaylist)), pulled.Load())
+}
+
+func TestManifestCacheRevalidatesWithTheETag(t *testing.T) {
+	var requests, notModified atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(liveTestPlaylist))
+	}))
+	defer origin.Close()
+	useManifestCache(t)
+
+	input := &model.Input{Url: origin.URL + "/live.m3u8", Encoded: "etag-test"}
+	first, _, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+
+	reloaded, err := manifests.reload(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int32(1), notModified.Load())
+	assert.Equal(t, liveTestPlaylist, reloaded.body)
+	assert.Equal(t, `"v1"`, reloaded.etag)
+	assert.False(t, reloaded.fetchedAt.Before(first.fetchedAt))
+}
+
+func TestManifestCacheRefetchesOnceTheTTLExpires(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(liveTestPlaylist))
+	}))
+	defer origin.Close()
+	useManifestCache(t)
+
+	input := &model.Input{Url: origin.URL + "/live.m3u8", Encoded: "ttl-test"}
+	entry, n, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(liveTestPlaylist)), n)
+	// half of the ten second target duration
+	assert.Equal(t, 5*time.Second, entry.ttl)
+
+	_, n, err = manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, int32(1), requests.Load())
+
+	expired := *entry
+	expired.fetchedAt = time.Now().Add(-entry.ttl)
+	manifests.put(manifestKey(input), &expired)
+	_, n, err = manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(liveTestPlaylist)), n)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestManifestCacheReplaysStoredVODPlaylists(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(vodTestPlaylist))
+	}))
+	defer origin.Close()
+	useManifestCache(t)
+	useStoredPlaylists(t)
+
+	input := &model.Input{Url: origin.URL + "/vod.m3u8", Encoded: "vod-test"}
+	_, _, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+
+	// as after a restart: nothing cached, but the store kept the complete playlist
+	manifests.reset()
+	entry, n, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, vodTestPlaylist, entry.body)
+	assert.Equal(t, origin.URL+"/vod.m3u8", entry.location().String())
+	assert.Zero(t, n)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestManifestCacheServesTheStoredPlaylistWhileTheOriginIsDown(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(masterTestPlaylist))
+	}))
+	useManifestCache(t)
+	useStoredPlaylists(t)
+
+	input := &model.Input{Url: origin.URL + "/master.m3u8", Encoded: "origin-down-test"}
+	_, _, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+
+	// master playlists are not replayed while the origin answers
+	manifests.reset()
+	_, _, err = manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+
+	origin.Close()
+	manifests.reset()
+	entry, n, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, masterTestPlaylist, entry.body)
+	assert.Zero(t, n)
+}
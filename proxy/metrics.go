@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// viewerWindow is how long a client counts as watching a manifest after its last request.
+const viewerWindow = time.Minute
+
+// viewerTracker remembers when each client last asked for a manifest or one of its segments.
+type viewerTracker struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+var viewers = &viewerTracker{seen: make(map[string]time.Time)}
+
+func (v *viewerTracker) record(client, manifestKey string) {
+	if client == "" || manifestKey == "" {
+		return
+	}
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.seen[client+"|"+manifestKey] = now
+	if now.Sub(v.lastPrune) > viewerWindow {
+		v.pruneLocked(now)
+	}
+}
+
+func (v *viewerTracker) count() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.pruneLocked(time.Now())
+	return len(v.seen)
+}
+
+func (v *viewerTracker) pruneLocked(now time.Time) {
+	for key, at := range v.seen {
+		if now.Sub(at) > viewerWindow {
+			delete(v.seen, key)
+		}
+	}
+	v.lastPrune = now
+}
+
+func metricDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc("hls_proxy_"+name, help, labels, nil)
+}
+
+var (
+	manifestsDesc      = metricDesc("manifests", "Manifests the proxy is tracking.")
+	viewersDesc        = metricDesc("viewers", "Distinct client and manifest pairs requested within the last minute.")
+	livePollersDesc    = metricDesc("live_pollers", "Live playlists being polled without a player attached.")
+	prefetchQueueDesc  = metricDesc("prefetch_queue_clips", "Clips of cached playlists not prefetched yet.")
+	prefetchFlightDesc = metricDesc("prefetch_in_flight", "Clips being prefetched right now.")
+	segmentLookupsDesc = metricDesc("segment_lookups_total", "Segment requests by the tier that answered them; tier=\"miss\" went to the origin.", "tier")
+	cacheLookupsDesc   = metricDesc("segment_cache_lookups_total", "In-memory segment cache lookups by result.", "result")
+	cacheEvictionsDesc = metricDesc("segment_cache_evictions_total", "Segments evicted from the in-memory cache.")
+	cacheBytesDesc     = metricDesc("segment_cache_bytes", "Bytes held by the in-memory segment cache.")
+	cacheEntriesDesc   = metricDesc("segment_cache_entries", "Segments held by the in-memory segment cache.")
+	storeBytesDesc     = metricDesc("segment_store_bytes", "Bytes held by the disk segment store.")
+	storeSegmentsDesc  = metricDesc("segment_store_segments", "Segments held by the disk segment store.")
+	storeEvictionsDesc = metricDesc("segment_store_evictions_total", "Segments evicted from the disk store to stay within its quota.")
+	storeFullDesc      = metricDesc("segment_store_full", "1 while the disk store refuses writes because free space is below the floor.")
+)
+
+// statsCollector reads the proxy's own counters at scrape time instead of mirroring them.
+type statsCollector struct{}
+
+func (statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		manifestsDesc, viewersDesc, livePollersDesc, prefetchQueueDesc, prefetchFlightDesc,
+		segmentLookupsDesc, cacheLookupsDesc, cacheEvictionsDesc, cacheBytesDesc, cacheEntriesDesc,
+		storeBytesDesc, storeSegmentsDesc, storeEvictionsDesc, storeFullDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (statsCollector) Collect(ch chan<- prometheus.Metric) {
+	overview := GetOverview()
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+
+	gauge(manifestsDesc, float64(overview.Manifests))
+	gauge(viewersDesc, float64(viewers.count()))
+	gauge(livePollersDesc, float64(overview.LivePollers))
+	gauge(prefetchFlightDesc, float64(overview.PrefetchInFlight))
+
+	pending := 0
+	for _, queue := range PrefetchQueues() {
+		pending += max(queue.Clips-queue.Fetched, 0)
+	}
+	gauge(prefetchQueueDesc, float64(pending))
+
+	for _, tier := range []hls.Tier{hls.TierPrefetch, hls.TierMemory, hls.TierDisk} {
+		counter(segmentLookupsDesc, float64(overview.Repository.Tiers[tier].Hits), string(tier))
+	}
+	counter(segmentLookupsDesc, float64(overview.Repository.Misses), "miss")
+
+	counter(cacheLookupsDesc, float64(overview.Cache.Hits), "hit")
+	counter(cacheLookupsDesc, float64(overview.Cache.Misses), "miss")
+	counter(cacheEvictionsDesc, float64(overview.Cache.Evictions))
+	gauge(cacheBytesDesc, float64(overview.Cache.Bytes))
+	gauge(cacheEntriesDesc, float64(overview.Cache.Entries))
+
+	gauge(storeBytesDesc, float64(overview.Store.Bytes))
+	gauge(storeSegmentsDesc, float64(overview.Store.Segments))
+	counter(storeEvictionsDesc, float64(overview.Store.Evictions))
+	full := 0.0
+	if overview.Store.Full {
+		full = 1
+	}
+	gauge(storeFullDesc, full)
+}
+
+// RegisterMetrics adds the proxy's cache, store, prefetch and viewer figures to the metrics
+// registry.
+func RegisterMetrics() {
+	metrics.Registry.MustRegister(statsCollector{})
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+const minPollInterval = 500 * time.Millisecond
+
+// livePoller refreshes a live media playlist on its own schedule so that the manifest
+// history and prefetcher keep advancing while the player stalls.
+type livePoller struct {
+	key      string
+	input    model.Input
+	lastBody string
+}
+
+var (
+	pollersMu sync.Mutex
+	pollers   = make(map[string]*livePoller)
+)
+
+// ensureLivePoller starts a background poller for the manifest unless one is already running.
+func ensureLivePoller(input *model.Input, body string) {
+	if !model.Configuration.ManifestPoll || preFetcher == nil {
+		return
+	}
+	if hls.IsMasterPlaylist(body) || containsEndList(body) {
+		return
+	}
+
+	key := manifestKey(input)
+	if key == "" {
+		return
+	}
+
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+	if _, running := pollers[key]; running {
+		return
+	}
+
+	poller := &livePoller{key: key, input: *input, lastBody: body}
+	pollers[key] = poller
+	go poller.run(hls.ParseTargetDuration(body))
+	log.Debugf("Started live poller for %s", key)
+}
+
+func (p *livePoller) run(targetDuration time.Duration) {
+	defer func() {
+		pollersMu.Lock()
+		delete(pollers, p.key)
+		pollersMu.Unlock()
+		log.Debugf("Stopped live poller for %s", p.key)
+	}()
+
+	wait := pollInterval(targetDuration)
+	var backoff time.Duration
+	for {
+		time.Sleep(wait)
+
+		if p.idle() {
+			return
+		}
+
+		body, changed, err := p.refresh()
+		switch {
+		case errors.Is(err, hls.ErrManifestInactive):
+			return
+		case err != nil:
+			log.Debugf("Live poller for %s failed: %v", p.key, err)
+			backoff = retryInterval(backoff, targetDuration)
+			wait = backoff
+			continue
+		}
+		backoff = 0
+
+		if containsEndList(body) {
+			return
+		}
+		if target := hls.ParseTargetDuration(body); target > 0 {
+			targetDuration = target
+		}
+
+		wait = pollInterval(targetDuration)
+		if !changed {
+			// RFC 8216 section 6.3.4: wait half the target duration after an unchanged reload
+			wait = max(wait/2, minPollInterval)
+		}
+	}
+}
+
+func (p *livePoller) refresh() (string, bool, error) {
+	ctx, span := tracing.Start(context.Background(), "poll manifest", tracing.FullURL(p.input.Url))
+	defer span.End()
+
+	entry, err := manifests.reload(ctx, &p.input)
+	if err != nil {
+		tracing.Fail(span, err)
+		return "", false, err
+	}
+
+	if entry.body == p.lastBody {
+		return entry.body, false, nil
+	}
+	p.lastBody = entry.body
+
+	if err := hls.RefreshM3u8(ctx, entry.body, entry.location(), preFetcher, &p.input); err != nil {
+		tracing.Fail(span, err)
+		return entry.body, true, err
+	}
+	return entry.body, true, nil
+}
+
+func (p *livePoller) idle() bool {
+	idleFor, ok := hls.ManifestIdleFor(p.key)
+	if !ok {
+		return true
+	}
+
+	timeout := model.Configuration.SegmentIdleTimeout
+	if !model.Configuration.SegmentIdleEnabled || timeout <= 0 {
+		timeout = model.Configuration.PlaylistRetention
+	}
+	return timeout > 0 && idleFor > timeout
+}
+
+// retryInterval is the wait after a failed reload: RetryRequestDelay at first, doubling with
+// each failure in a row, and never longer than the poll interval itself.
+func retryInterval(previous, targetDuration time.Duration) time.Duration {
+	wait := max(config.Settings.RetryRequestDelay, minPollInterval)
+	if previous > 0 {
+		wait = previous * 2
+	}
+	return min(wait, pollInterval(targetDuration))
+}
+
+func pollInterval(targetDuration time.Duration) time.Duration {
+	if targetDuration <= 0 {
+		return time.Second
+	}
+	return max(targetDuration, minPollInterval)
+}
+
+func manifestKey(input *model.Input) string {
+	if input.Encoded != "" {
+		return input.Encoded
+	}
+	return input.Url
+}
+
+func containsEndList(body string) bool {
+	return strings.Contains(body, "#EXT-X-ENDLIST")
+}
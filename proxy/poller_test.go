@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollIntervalFollowsTargetDuration(t *testing.T) {
+	assert.Equal(t, time.Second, pollInterval(0))
+	assert.Equal(t, minPollInterval, pollInterval(100*time.Millisecond))
+	assert.Equal(t, 6*time.Second, pollInterval(6*time.Second))
+}
+
+func TestRetryIntervalBacksOffUpToTheTargetDuration(t *testing.T) {
+	previous := config.Settings.RetryRequestDelay
+	t.Cleanup(func() { config.Settings.RetryRequestDelay = previous })
+	config.Settings.RetryRequestDelay = time.Second
+
+	var waits []time.Duration
+	var wait time.Duration
+	for range 5 {
+		wait = retryInterval(wait, 6*time.Second)
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 6 * time.Second, 6 * time.Second}, waits)
+	// short segments cap the backoff below the retry delay
+	assert.Equal(t, minPollInterval, retryInterval(0, 200*time.Millisecond))
+}
+
+func TestLivePollerReloadsPastTheManifestCache(t *testing.T) {
+	// a live origin whose window only moves when the test says so
+	var sequence, requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		first := int(sequence.Load())
+		var b strings.Builder
+		fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+		for i := first; i < first+3; i++ {
+			fmt.Fprintf(&b, "#EXTINF:10.0,\nseg-%d.ts\n", i)
+		}
+		w.Write([]byte(b.String()))
+	}))
+	defer origin.Close()
+
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	previous := model.Configuration
+	model.Configuration.Attempts = 1
+	model.Configuration.ManifestCacheFraction = 0.5
+	previousPrefetcher := preFetcher
+	preFetcher = hls.NewPrefetcher(1, time.Minute, time.Minute)
+	t.Cleanup(func() {
+		upstream.Use(&upstream.Policy{})
+		model.Configuration = previous
+		preFetcher = previousPrefetcher
+		manifests.reset()
+	})
+
+	input := &model.Input{Url: origin.URL + "/live.m3u8", Encoded: "poller-test"}
+	entry, _, err := manifests.fetch(context.Background(), input)
+	require.NoError(t, err)
+	_, err = hls.ModifyM3u8(context.Background(), entry.body, entry.location(), preFetcher, input, "proxy.example")
+	require.NoError(t, err)
+	poller := &livePoller{key: manifestKey(input), input: *input, lastBody: entry.body}
+
+	// the cached copy is still fresh for five seconds, but the poller must not be served it
+	sequence.Store(1)
+	body, changed, err := poller.refresh()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, body, "seg-3.ts")
+	assert.Equal(t, int32(2), requests.Load())
+
+	_, changed, err = poller.refresh()
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, int32(3), requests.Load())
+}
@@ -1,21 +1,29 @@
 package proxy
 
 import (
+	"context"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/bariiss/hls-proxy/config"
 	"github.com/bariiss/hls-proxy/encryption"
 	"github.com/bariiss/hls-proxy/hls"
 	"github.com/bariiss/hls-proxy/http_retry"
 	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/parsing"
+	"github.com/bariiss/hls-proxy/tracing"
+	"github.com/bariiss/hls-proxy/upstream"
 	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var preFetcher *hls.Prefetcher
+var (
+	preFetcher *hls.Prefetcher
+	segments   *hls.SegmentRepository
+)
 
 // simpleCounterWriter counts bytes written to it (used with io.TeeReader)
 type simpleCounterWriter struct{ n int64 }
@@ -27,18 +35,34 @@ func (w *simpleCounterWriter) Write(p []byte) (int, error) {
 
 func InitPrefetcher(c *model.Config) {
 	preFetcher = hls.NewPrefetcherWithJanitor(c.SegmentCount, c.JanitorInterval, c.PlaylistRetention, c.ClipRetention)
-	if err := hls.ConfigureSegmentStore(c.SegmentStore, c.SegmentStorageDir); err != nil {
+	segments = hls.NewSegmentRepository(preFetcher)
+	if err := hls.ConfigureSegmentStore(c.SegmentStore, c.SegmentStorageDir, c.SegmentStorePersist); err != nil {
 		log.Errorf("segment persistence disabled: %v", err)
+	} else if c.SegmentStore && strings.EqualFold(c.SegmentStoreBackend, "s3") {
+		log.Infof("Persisting segments to s3 bucket %s under %q", c.S3Bucket, c.S3Prefix)
+	} else if c.SegmentStore && c.SegmentStorePersist {
+		log.Infof("Persisting segments to %s across restarts", c.SegmentStorageDir)
 	} else if c.SegmentStore {
 		log.Infof("Persisting segments to %s", c.SegmentStorageDir)
 	}
-	hls.ConfigureSegmentCache(c.SegmentCache, c.SegmentCount)
+	if c.SegmentStore && c.SegmentStoreMaxBytes > 0 {
+		log.Infof("Segment store quota is %d bytes", c.SegmentStoreMaxBytes)
+	}
+	if err := hls.ConfigureSharedState(c); err != nil {
+		log.Errorf("shared state disabled, keeping manifest state in memory: %v", err)
+	} else if strings.EqualFold(c.StateBackend, "redis") {
+		log.Infof("Sharing manifest state and segments up to %d bytes through redis", c.RedisSegmentMaxBytes)
+	}
+	hls.ConfigureSegmentCache(c.SegmentCache, c.SegmentCacheMaxBytes)
 	if c.SegmentCache {
-		log.Infof("In-memory segment cache enabled with limit %d", c.SegmentCount)
+		log.Infof("In-memory segment cache enabled with a %d byte budget", c.SegmentCacheMaxBytes)
 	}
 	if c.SegmentBackgroundFetch {
 		log.Info("Background segment fetch enabled; manifests will trigger proactive downloads")
 	}
+	if c.ManifestPoll {
+		log.Info("Live manifest polling enabled; media playlists refresh independently of players")
+	}
 	if c.SegmentIdleEnabled && c.SegmentIdleTimeout > 0 {
 		hls.StartManifestInactivityJanitor(preFetcher, c.SegmentIdleTimeout)
 	} else {
@@ -46,35 +70,36 @@ func InitPrefetcher(c *model.Config) {
 	}
 }
 
-func ManifestProxy(c echo.Context, input *model.Input) error {
-	req, err := http.NewRequest("GET", input.Url, nil)
-	if err != nil {
-		return err
+// SegmentRepositoryStats reports how many segment lookups each cache tier answered.
+func SegmentRepositoryStats() hls.RepositoryStats {
+	if segments == nil {
+		return hls.RepositoryStats{}
 	}
-	addBaseHeaders(req, input)
+	return segments.Stats()
+}
+
+func ManifestProxy(c echo.Context, input *model.Input) error {
+	ctx, span := tracing.Start(c.Request().Context(), "ManifestProxy", tracing.FullURL(input.Url))
+	defer span.End()
 
-	resp, err := http_retry.ExecuteRetryableRequest(req, 3)
+	entry, upstream, err := manifests.fetch(ctx, input)
 	if err != nil {
+		tracing.Fail(span, err)
 		return err
 	}
-	defer resp.Body.Close()
-
-	finalURL := resp.Request.URL
+	viewers.record(c.RealIP(), manifestKey(input))
 
 	start := time.Now()
 
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	// record upstream manifest size for logging
-	c.Set("bytes_upstream", int64(len(bytes)))
+	// record upstream manifest size for logging; zero when served from the shared cache
+	c.Set("bytes_upstream", upstream)
 
-	res, err := hls.ModifyM3u8(string(bytes), finalURL, preFetcher, input, c.Request().Host)
+	res, err := hls.ModifyM3u8(ctx, entry.body, entry.location(), preFetcher, input, c.Request().Host)
 	if err != nil {
+		tracing.Fail(span, err)
 		return err
 	}
+	ensureLivePoller(input, entry.body)
 
 	elapsed := time.Since(start)
 	log.Debug("Modifying manifest took ", elapsed)
@@ -85,8 +110,14 @@ func ManifestProxy(c echo.Context, input *model.Input) error {
 
 func TsProxy(c echo.Context, input *model.Input) error {
 	//parse incomming base64 query string and decde it into model struct
+	// the origin fetch below runs under a context derived from ctx, so the egress goes on ctx
+	ctx, span := tracing.Start(upstream.WithProxy(c.Request().Context(), input.Proxy), "TsProxy", tracing.FullURL(input.Url))
+	defer span.End()
 
-	pId := c.QueryParam("pId")
+	pId, err := parsing.OpenValue(c.QueryParam("pId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 	manifestID := pId
 	if manifestID == "" {
 		manifestID = input.Encoded
@@ -96,15 +127,17 @@ func TsProxy(c echo.Context, input *model.Input) error {
 	}
 	hls.TouchManifest(manifestID)
 	hls.RecordSegmentRequest(manifestID)
+	viewers.record(c.RealIP(), manifestID)
 
 	//check if we have the ts file in cache
 
 	decryptionKey := c.QueryParam("key")
 	initialVector := c.QueryParam("iv")
 
-	req, err := http.NewRequest("GET", input.Url, nil)
+	// origin fetches outlive a player hanging up, so the cache still gets the segment
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "GET", input.Url, nil)
 
-	addBaseHeaders(req, input)
+	http_retry.SetBaseHeaders(req, input)
 
 	if err != nil {
 		return err
@@ -117,46 +150,91 @@ func TsProxy(c echo.Context, input *model.Input) error {
 
 	rangeHeader := c.Request().Header.Get("Range")
 
-	var (
-		rawData []byte
-		found   bool
-	)
-
-	if pId != "" && model.Configuration.Prefetch {
-		start := time.Now()
-		rawData, found = preFetcher.GetFetchedClip(pId, input.Url)
-		log.Debug("Fetching clip from cache took ", time.Since(start))
+	start := time.Now()
+	_, lookup := tracing.Start(ctx, "segment lookup")
+	content, tier, found := segments.Open(ctx, pId, manifestID, input.Url)
+	lookup.SetAttributes(attribute.Bool("segment.hit", found), attribute.String("segment.tier", string(tier)))
+	lookup.End()
+	if found {
+		defer content.Close()
+		log.Debug("Serving clip from ", tier, " tier after ", time.Since(start))
+		setContentTypeHeader(c, input.Url, "")
+		if decryptionKey != "" {
+			rawData, err := content.Bytes()
+			if err != nil {
+				log.Error("Error reading stored segment ", err)
+				return err
+			}
+			decrypted, err := decryptSegment(ctx, rawData, decryptionKey, initialVector)
+			if err != nil {
+				log.Error("Error decrypting stored segment ", err)
+				return err
+			}
+			serveSegmentBytes(c, input.Url, decrypted)
+			return nil
+		}
+		serveSegment(c, content, content.ETag, content.ModTime)
+		return nil
 	}
 
-	if !found && model.Configuration.SegmentCache && rangeHeader == "" {
-		rawData, found = hls.LoadSegmentCache(manifestID, input.Url)
-	}
+	// joining other players' fetches only pays off when the body is kept afterwards
+	if rangeHeader == "" && hls.KeepsSegments() {
+		streamed := false
+		segment, fetched, err := hls.FetchSegmentOnce(manifestID, input.Url, func() (hls.FetchedSegment, error) {
+			log.Debug("Fetching clip from origin")
+			fetchCtx, fetch := tracing.Start(ctx, "origin fetch")
+			defer fetch.End()
+			resp, err := http_retry.ExecuteRetryableRequest(req.WithContext(context.WithoutCancel(fetchCtx)), model.Configuration.Attempts)
+			if err != nil {
+				tracing.Fail(fetch, err)
+				return hls.FetchedSegment{}, err
+			}
+			defer resp.Body.Close()
+			fetched := hls.FetchedSegment{ContentType: resp.Header.Get("Content-Type")}
+			if decryptionKey != "" {
+				fetched.Data, err = io.ReadAll(resp.Body)
+				return fetched, err
+			}
+			// the player gets the body as it arrives; the cache only gets it once it is complete
+			streamed = true
+			fetched.Data, err = teeSegment(c, input.Url, resp)
+			return fetched, err
+		})
+		rawData := segment.Data
+		span.SetAttributes(attribute.Bool("segment.joined_fetch", !fetched))
+		if streamed {
+			if err != nil {
+				tracing.Fail(span, err)
+				abortResponse("Error streaming segment ", err)
+			}
+			c.Set("bytes_upstream", int64(len(rawData)))
+			return nil
+		}
+		if err != nil {
+			log.Error("Error reading segment ", err)
+			return err
+		}
 
-	if !found && model.Configuration.SegmentStore && rangeHeader == "" {
-		var loadErr error
-		rawData, found, loadErr = hls.LoadSegment(manifestID, input.Url)
-		if loadErr != nil {
-			log.Error("Error loading segment from store: ", loadErr)
+		// record upstream segment size for logging; zero when another request did the fetch
+		if fetched {
+			c.Set("bytes_upstream", int64(len(rawData)))
+		} else {
+			log.Debug("Served clip from an in-flight fetch")
 		}
-	}
 
-	if found {
+		setContentTypeHeader(c, input.Url, segment.ContentType)
 		if decryptionKey != "" {
-			decrypted, err := encryption.DecryptSegment(rawData, decryptionKey, initialVector)
+			rawData, err = decryptSegment(ctx, rawData, decryptionKey, initialVector)
 			if err != nil {
-				log.Error("Error decrypting stored segment ", err)
+				log.Error("Error decrypting segment ", err)
 				return err
 			}
-			setContentTypeHeader(c, input.Url, "")
-			c.Response().Writer.Write(decrypted)
-			return nil
 		}
-		setContentTypeHeader(c, input.Url, "")
-		c.Response().Writer.Write(rawData)
+		serveSegmentBytes(c, input.Url, rawData)
 		return nil
 	}
 
-	log.Debug("Fetching clip from origin")
+	log.Debug("Streaming clip from origin")
 
 	//send request to original host
 	resp, err := http_retry.ExecuteRetryableRequest(req, model.Configuration.Attempts)
@@ -171,9 +249,8 @@ func TsProxy(c echo.Context, input *model.Input) error {
 
 	setContentTypeHeader(c, input.Url, resp.Header.Get("Content-Type"))
 
-	readBody := decryptionKey != "" || (model.Configuration.SegmentCache && rangeHeader == "") || model.Configuration.SegmentStore
-	if readBody {
-		rawData, err = io.ReadAll(resp.Body)
+	if decryptionKey != "" {
+		rawData, err := io.ReadAll(resp.Body)
 		if err != nil {
 			log.Error("Error reading segment ", err)
 			return err
@@ -181,38 +258,40 @@ func TsProxy(c echo.Context, input *model.Input) error {
 
 		// record upstream segment size for logging
 		c.Set("bytes_upstream", int64(len(rawData)))
-		if model.Configuration.SegmentStore && rangeHeader == "" {
-			if err := hls.SaveSegment(manifestID, input.Url, rawData); err != nil {
-				log.Warn("Failed to persist segment from origin: ", err)
-			}
-		}
-		if model.Configuration.SegmentCache && rangeHeader == "" {
-			hls.SaveSegmentCache(manifestID, input.Url, rawData)
-		}
-		if decryptionKey != "" {
-			rawData, err = encryption.DecryptSegment(rawData, decryptionKey, initialVector)
-			if err != nil {
-				log.Error("Error decrypting segment ", err)
-				return err
-			}
+		rawData, err = decryptSegment(ctx, rawData, decryptionKey, initialVector)
+		if err != nil {
+			log.Error("Error decrypting segment ", err)
+			return err
 		}
 		c.Response().Writer.Write(rawData)
 		return nil
 	}
 
 	// When not reading the body into memory, stream and count upstream bytes
+	if resp.ContentLength >= 0 {
+		c.Response().Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	c.Response().WriteHeader(resp.StatusCode)
 	cw := &simpleCounterWriter{}
 	tee := io.TeeReader(resp.Body, cw)
 	// copy to response writer so our countingResponseWriter captures bytes_out
 	if _, err := io.Copy(c.Response().Writer, tee); err != nil {
 		resp.Body.Close()
-		return err
+		abortResponse("Error streaming segment ", err)
 	}
 	resp.Body.Close()
 	c.Set("bytes_upstream", cw.n)
 	return nil
 }
 
+func decryptSegment(ctx context.Context, data []byte, key string, iv string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "decrypt segment", attribute.Int("segment.size", len(data)))
+	defer span.End()
+	decrypted, err := encryption.DecryptSegment(data, key, iv)
+	tracing.Fail(span, err)
+	return decrypted, err
+}
+
 func setContentTypeHeader(c echo.Context, name string, override string) string {
 	contentType := override
 	if contentType == "" {
@@ -224,17 +303,6 @@ func setContentTypeHeader(c echo.Context, name string, override string) string {
 	return contentType
 }
 
-func addBaseHeaders(req *http.Request, input *model.Input) {
-	//add headers if applicable
-	if input.Referer != "" {
-		req.Header.Add("Referer", input.Referer)
-	}
-	if input.Origin != "" {
-		req.Header.Add("Origin", input.Origin)
-	}
-	req.Header.Add("User-Agent", config.Settings.UserAgent)
-}
-
 func detectContentType(name string) string {
 	lname := strings.ToLower(name)
 	switch {
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// sendfileResponse lets io.Copy inside http.ServeContent reach the connection's ReadFrom,
+// so stored files go out with sendfile, while echo still records the response status.
+type sendfileResponse struct {
+	*echo.Response
+}
+
+func (w sendfileResponse) ReadFrom(r io.Reader) (int64, error) {
+	if !w.Committed {
+		w.WriteHeader(http.StatusOK)
+	}
+	if readerFrom, ok := w.Writer.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(r)
+	}
+	return io.Copy(w.Writer, r)
+}
+
+// serveSegment answers the request from content with http.ServeContent, which takes care of
+// Range, If-Range, conditional requests and Content-Length. The Content-Type header must
+// already be set.
+func serveSegment(c echo.Context, content io.ReadSeeker, etag string, modTime time.Time) {
+	if etag != "" {
+		c.Response().Header().Set("ETag", etag)
+	}
+	http.ServeContent(sendfileResponse{c.Response()}, c.Request(), "", modTime, content)
+}
+
+// serveSegmentBytes serves a segment held in memory.
+func serveSegmentBytes(c echo.Context, clipUrl string, data []byte) {
+	serveSegment(c, bytes.NewReader(data), hls.SegmentETag(clipUrl, int64(len(data))), time.Time{})
+}
+
+// detachingWriter forwards to the player until a write fails, then discards the rest, so a
+// player hanging up does not abort the download the cache is waiting for.
+type detachingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *detachingWriter) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return len(p), nil
+	}
+	if _, err := d.w.Write(p); err != nil {
+		log.Debug("Player went away while streaming segment: ", err)
+		d.err = err
+	}
+	return len(p), nil
+}
+
+// maxSegmentPrealloc bounds the buffer reserved up front from an origin's Content-Length,
+// which the origin is free to inflate; larger bodies still grow the buffer as they arrive.
+const maxSegmentPrealloc = 16 << 20
+
+// abortResponse logs a failure that happened after the response headers went out and drops
+// the connection, so the player sees a truncated transfer rather than a complete-looking body.
+func abortResponse(message string, err error) {
+	log.Error(message, err)
+	panic(http.ErrAbortHandler)
+}
+
+// teeSegment streams an origin response to the player while buffering it. The buffered body
+// is only returned, and so only cached, when it is complete and matches Content-Length.
+func teeSegment(c echo.Context, clipUrl string, resp *http.Response) ([]byte, error) {
+	header := c.Response().Header()
+	setContentTypeHeader(c, clipUrl, resp.Header.Get("Content-Type"))
+	var buffer bytes.Buffer
+	if resp.ContentLength >= 0 {
+		header.Set("Content-Length", fmt.Sprint(resp.ContentLength))
+		header.Set("ETag", hls.SegmentETag(clipUrl, resp.ContentLength))
+		buffer.Grow(int(min(resp.ContentLength, maxSegmentPrealloc)))
+	}
+	c.Response().WriteHeader(http.StatusOK)
+
+	player := &detachingWriter{w: c.Response()}
+	if _, err := io.Copy(io.MultiWriter(&buffer, player), resp.Body); err != nil {
+		return nil, err
+	}
+	if resp.ContentLength >= 0 && int64(buffer.Len()) != resp.ContentLength {
+		return nil, fmt.Errorf("segment body has %d of %d bytes", buffer.Len(), resp.ContentLength)
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncatedOriginBodyAbortsTheSegmentResponse(t *testing.T) {
+	// the origin promises far more than it sends, then hangs up
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000000000")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer origin.Close()
+
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	previous := model.Configuration
+	model.Configuration.Attempts = 1
+	previousSegments := segments
+	segments = hls.NewSegmentRepository(nil)
+	hls.ConfigureSegmentCache(true, 1<<20)
+	t.Cleanup(func() {
+		upstream.Use(&upstream.Policy{})
+		model.Configuration = previous
+		segments = previousSegments
+		hls.ConfigureSegmentCache(false, 0)
+	})
+
+	input := &model.Input{Url: origin.URL + "/a.ts", Encoded: "truncated-test"}
+	var handled atomic.Int32
+	e := echo.New()
+	e.Use(middleware.Recover())
+	e.HTTPErrorHandler = func(err error, c echo.Context) { handled.Add(1) }
+	e.GET("/a.ts", func(c echo.Context) error { return TsProxy(c, input) })
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// the connection drops before or during the body, never with a body that looks complete
+	resp, err := http.Get(server.URL + "/a.ts")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+
+	// the failure is not handed to echo once the headers went out, and nothing was cached
+	assert.Equal(t, int32(0), handled.Load())
+	_, ok := hls.LoadSegmentCache(input.Encoded, input.Url)
+	assert.False(t, ok)
+}
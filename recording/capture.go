@@ -0,0 +1,379 @@
+package recording
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bariiss/hls-proxy/config"
+	"github.com/bariiss/hls-proxy/hls"
+	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxPlaylistFailures = 5
+
+// capture polls the job's media playlist until the deadline on ctx, writing every new
+// segment and a local index.m3u8 into the job's output directory. A job resumed after a
+// restart appends to what it already captured.
+func (s *Scheduler) capture(ctx context.Context, job Job) error {
+	if err := os.MkdirAll(job.OutputDir, 0o755); err != nil {
+		return fmt.Errorf("create recording directory: %w", err)
+	}
+
+	mediaURL, err := resolveMediaPlaylist(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	writer, err := loadPlaylistWriter(filepath.Join(job.OutputDir, "index.m3u8"))
+	if err != nil {
+		return err
+	}
+	// segments written before a crash may be missing from the index, so never reuse their names
+	next := max(len(writer.entries), job.Segments)
+	lastSegment := job.LastSegment
+	seen := make(map[string]struct{})
+	failures := 0
+	first := true
+
+	for {
+		body, finalURL, err := fetchPlaylist(ctx, mediaURL, job.Headers)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failures++
+			if failures >= maxPlaylistFailures {
+				_ = writer.flush(true)
+				return fmt.Errorf("fetch media playlist: %w", err)
+			}
+			log.Debugf("Recording job %s: playlist fetch failed (%d/%d): %v", job.ID, failures, maxPlaylistFailures, err)
+			if !sleep(ctx, config.Settings.RetryRequestDelay) {
+				break
+			}
+			continue
+		}
+		failures = 0
+
+		playlist := hls.ParseMediaPlaylist(body, hls.ParentURL(finalURL))
+		if playlist.MapURL != "" && writer.mapName == "" {
+			name := "init" + segmentExtension(playlist.MapURL, ".mp4")
+			if _, err := downloadTo(ctx, playlist.MapURL, job.Headers, filepath.Join(job.OutputDir, name)); err != nil {
+				log.Warnf("Recording job %s: failed to fetch init segment: %v", job.ID, err)
+			} else {
+				writer.mapName = name
+			}
+		}
+
+		segments := playlist.Segments
+		if first {
+			if resumed := afterSegment(segments, lastSegment); resumed != nil {
+				// the origin still lists where the job left off, so nothing was missed
+				segments = resumed
+				writer.discontinuity = false
+			} else if !playlist.EndList {
+				segments = liveEdge(segments, playlist.TargetDuration)
+			}
+		}
+		first = false
+
+		added := 0
+		var addedBytes int64
+		for _, segment := range segments {
+			if _, ok := seen[segment.URL]; ok {
+				continue
+			}
+			seen[segment.URL] = struct{}{}
+			if ctx.Err() != nil {
+				break
+			}
+
+			name := fmt.Sprintf("%06d%s", next, segmentExtension(segment.URL, ".ts"))
+			next++
+			size, err := downloadTo(ctx, segment.URL, job.Headers, filepath.Join(job.OutputDir, name))
+			if err != nil {
+				log.Warnf("Recording job %s: failed to fetch segment %s: %v", job.ID, segment.URL, err)
+				writer.discontinuity = true
+				continue
+			}
+			writer.add(segment, name)
+			lastSegment = segment.URL
+			added++
+			addedBytes += size
+		}
+
+		if err := writer.flush(false); err != nil {
+			return err
+		}
+		if added > 0 {
+			s.recordProgress(job.ID, added, addedBytes, lastSegment)
+		}
+		if playlist.EndList {
+			break
+		}
+
+		wait := playlist.TargetDuration
+		if added == 0 {
+			// RFC 8216 section 6.3.4: back off to half the target duration when nothing changed
+			wait /= 2
+		}
+		if wait <= 0 {
+			wait = time.Second
+		}
+		if !sleep(ctx, wait) {
+			break
+		}
+	}
+
+	return writer.flush(true)
+}
+
+func resolveMediaPlaylist(ctx context.Context, job Job) (string, error) {
+	body, finalURL, err := fetchPlaylist(ctx, job.Url, job.Headers)
+	if err != nil {
+		return "", fmt.Errorf("fetch playlist: %w", err)
+	}
+	if !hls.IsMasterPlaylist(body) {
+		return job.Url, nil
+	}
+
+	variants := hls.ParseVariants(body, hls.ParentURL(finalURL))
+	variant, ok := hls.SelectVariant(variants, job.Variant)
+	if !ok {
+		return "", fmt.Errorf("no variant matches %q", job.Variant)
+	}
+	log.Infof("Recording job %s: selected variant %dx%d @ %d bps", job.ID, variant.Width, variant.Height, variant.Bandwidth)
+	return variant.URL, nil
+}
+
+func fetchPlaylist(ctx context.Context, playlistURL string, headers map[string]string) (string, *url.URL, error) {
+	req, err := newRequest(ctx, playlistURL, headers)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := http_retry.ExecuteRetryableRequest(req, model.Configuration.Attempts)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(body), resp.Request.URL, nil
+}
+
+func downloadTo(ctx context.Context, segmentURL string, headers map[string]string, dest string) (int64, error) {
+	req, err := newRequest(ctx, segmentURL, headers)
+	if err != nil {
+		return 0, err
+	}
+	data, err := http_retry.ExecuteRetryClipRequest(req, model.Configuration.Attempts)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(dest, data); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func newRequest(ctx context.Context, target string, headers map[string]string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", config.Settings.UserAgent)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// afterSegment returns the segments following last, or nil when last is not in the playlist.
+func afterSegment(segments []hls.MediaSegment, last string) []hls.MediaSegment {
+	if last == "" {
+		return nil
+	}
+	for i, segment := range segments {
+		if segment.URL == last {
+			return segments[i+1:]
+		}
+	}
+	return nil
+}
+
+// liveEdge keeps the segments a player would start from: the last three target durations.
+func liveEdge(segments []hls.MediaSegment, target time.Duration) []hls.MediaSegment {
+	if target <= 0 || len(segments) <= 3 {
+		return segments
+	}
+	var total time.Duration
+	for i := len(segments) - 1; i >= 0; i-- {
+		total += segments[i].Duration
+		if total >= 3*target {
+			return segments[i:]
+		}
+	}
+	return segments
+}
+
+func segmentExtension(rawURL, fallback string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fallback
+	}
+	ext := path.Ext(parsed.Path)
+	if ext == "" || len(ext) > 5 {
+		return fallback
+	}
+	return ext
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func writeFileAtomic(dest string, data []byte) error {
+	tmp := dest + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write recording temp file: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("finalize recording file: %w", err)
+	}
+	return nil
+}
+
+type playlistEntry struct {
+	tags          []string
+	key           string
+	name          string
+	duration      time.Duration
+	discontinuity bool
+}
+
+// playlistWriter renders the captured segments as an EVENT playlist that is closed with
+// #EXT-X-ENDLIST once the recording ends.
+type playlistWriter struct {
+	path          string
+	mapName       string
+	entries       []playlistEntry
+	discontinuity bool
+}
+
+// loadPlaylistWriter picks up the index a resumed job already wrote. Whatever was missed
+// while the proxy was down is marked as a discontinuity.
+func loadPlaylistWriter(indexPath string) (*playlistWriter, error) {
+	w := &playlistWriter{path: indexPath}
+	data, err := os.ReadFile(indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read recording index: %w", err)
+	}
+
+	playlist := hls.ParseMediaPlaylist(string(data), "")
+	if playlist.MapURL != "" {
+		w.mapName = playlist.MapURL
+	}
+	for _, segment := range playlist.Segments {
+		key := segment.Key
+		if strings.Contains(key, "METHOD=NONE") {
+			key = ""
+		}
+		w.entries = append(w.entries, playlistEntry{
+			tags:     segment.Tags,
+			key:      key,
+			name:     segment.URL,
+			duration: segment.Duration,
+		})
+	}
+	w.discontinuity = len(w.entries) > 0
+	return w, nil
+}
+
+func (w *playlistWriter) add(segment hls.MediaSegment, name string) {
+	w.entries = append(w.entries, playlistEntry{
+		tags:          segment.Tags,
+		key:           segment.Key,
+		name:          name,
+		duration:      segment.Duration,
+		discontinuity: w.discontinuity,
+	})
+	w.discontinuity = false
+}
+
+func (w *playlistWriter) flush(final bool) error {
+	if len(w.entries) == 0 && !final {
+		return nil
+	}
+
+	target := 1.0
+	for _, entry := range w.entries {
+		target = math.Max(target, math.Ceil(entry.duration.Seconds()))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if w.mapName != "" {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	b.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(int(target)) + "\n")
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	if w.mapName != "" {
+		b.WriteString("#EXT-X-MAP:URI=\"" + w.mapName + "\"\n")
+	}
+
+	currentKey := ""
+	for _, entry := range w.entries {
+		if entry.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if entry.key != currentKey {
+			key := entry.key
+			if key == "" {
+				key = "#EXT-X-KEY:METHOD=NONE"
+			}
+			b.WriteString(key + "\n")
+			currentKey = entry.key
+		}
+		for _, tag := range entry.tags {
+			if tag == "#EXT-X-DISCONTINUITY" && entry.discontinuity {
+				continue
+			}
+			b.WriteString(tag + "\n")
+		}
+		b.WriteString(entry.name + "\n")
+	}
+	if final {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return writeFileAtomic(w.path, []byte(b.String()))
+}
@@ -0,0 +1,93 @@
+package recording
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureResumesWithoutOverwritingSegments(t *testing.T) {
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	attempts := model.Configuration.Attempts
+	model.Configuration.Attempts = 1
+	t.Cleanup(func() {
+		upstream.Use(&upstream.Policy{})
+		model.Configuration.Attempts = attempts
+	})
+
+	// the live window moves from segments 0-2 to 1-4 and then the event ends
+	var window atomic.Pointer[[2]int]
+	window.Store(&[2]int{0, 2})
+	ended := atomic.Bool{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			w.Write([]byte("segment " + strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/seg-"), ".ts")))
+			return
+		}
+		bounds := window.Load()
+		var b strings.Builder
+		fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", bounds[0])
+		for i := bounds[0]; i <= bounds[1]; i++ {
+			fmt.Fprintf(&b, "#EXTINF:1.0,\nseg-%d.ts\n", i)
+		}
+		if ended.Load() {
+			b.WriteString("#EXT-X-ENDLIST\n")
+		}
+		w.Write([]byte(b.String()))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	s, err := NewScheduler(dir)
+	require.NoError(t, err)
+	job := &Job{
+		ID:        "job1",
+		Url:       origin.URL + "/live.m3u8",
+		Start:     time.Now(),
+		Duration:  Duration(time.Hour),
+		Status:    StatusRecording,
+		OutputDir: filepath.Join(dir, "job1"),
+	}
+	require.NoError(t, s.store.put(job))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	require.NoError(t, s.capture(ctx, *job))
+
+	// a restarted proxy resumes the job after the last segment it captured
+	window.Store(&[2]int{1, 4})
+	ended.Store(true)
+	resumed, ok := s.store.get("job1")
+	require.True(t, ok)
+	assert.Equal(t, 3, resumed.Segments)
+	require.NoError(t, s.capture(context.Background(), resumed))
+
+	for i := 0; i <= 4; i++ {
+		data, err := os.ReadFile(filepath.Join(job.OutputDir, fmt.Sprintf("%06d.ts", i)))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("segment %d", i), string(data))
+	}
+	index, err := os.ReadFile(filepath.Join(job.OutputDir, "index.m3u8"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, strings.Count(string(index), "#EXTINF"))
+	assert.NotContains(t, string(index), "#EXT-X-DISCONTINUITY")
+	assert.True(t, strings.HasSuffix(string(index), "000004.ts\n#EXT-X-ENDLIST\n"))
+
+	finished, _ := s.store.get("job1")
+	assert.Equal(t, 5, finished.Segments)
+	assert.Equal(t, origin.URL+"/seg-4.ts", finished.LastSegment)
+}
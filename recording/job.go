@@ -0,0 +1,101 @@
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusScheduled Status = "scheduled"
+	StatusRecording Status = "recording"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Duration wraps time.Duration so jobs read and write durations as "1h30m" strings.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		parsed, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return errors.New("duration must be a string like \"30m\" or a number of seconds")
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// JobRequest is the payload accepted by the schedule API and CLI.
+type JobRequest struct {
+	Url      string            `json:"url"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Start    time.Time         `json:"start"`
+	Duration Duration          `json:"duration"`
+	Variant  string            `json:"variant,omitempty"`
+}
+
+// Job is a scheduled capture of a stream, persisted by the job store.
+type Job struct {
+	ID          string            `json:"id"`
+	Url         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Start       time.Time         `json:"start"`
+	Duration    Duration          `json:"duration"`
+	Variant     string            `json:"variant,omitempty"`
+	Status      Status            `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   time.Time         `json:"started_at,omitzero"`
+	FinishedAt  time.Time         `json:"finished_at,omitzero"`
+	OutputDir   string            `json:"output_dir,omitempty"`
+	Segments    int               `json:"segments"`
+	Bytes       int64             `json:"bytes"`
+	LastSegment string            `json:"last_segment,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// End returns the time at which the capture stops.
+func (j *Job) End() time.Time {
+	return j.Start.Add(time.Duration(j.Duration))
+}
+
+func (j *Job) finished() bool {
+	switch j.Status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r JobRequest) validate() error {
+	url := strings.TrimSpace(r.Url)
+	if url == "" {
+		return fmt.Errorf("%w: url is required", ErrInvalidJob)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("%w: unsupported url %q", ErrInvalidJob, url)
+	}
+	if r.Duration <= 0 {
+		return fmt.Errorf("%w: duration must be positive", ErrInvalidJob)
+	}
+	return nil
+}
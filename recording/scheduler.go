@@ -0,0 +1,294 @@
+package recording
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrJobNotFound       = errors.New("recording job not found")
+	ErrInvalidJob        = errors.New("invalid recording job")
+	ErrSchedulerDisabled = errors.New("recording scheduler is not running")
+)
+
+// Scheduler starts captures at their scheduled time and tracks them in the job store.
+type Scheduler struct {
+	store     *jobStore
+	outputDir string
+
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	cancels map[string]context.CancelFunc
+}
+
+var scheduler *Scheduler
+
+// InitScheduler loads persisted jobs from the recording directory and re-arms pending ones.
+func InitScheduler(c *model.Config) error {
+	s, err := NewScheduler(c.RecordingDir)
+	if err != nil {
+		return err
+	}
+	scheduler = s
+	return nil
+}
+
+func NewScheduler(outputDir string) (*Scheduler, error) {
+	store, err := newJobStore(filepath.Join(outputDir, "jobs.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scheduler{
+		store:     store,
+		outputDir: outputDir,
+		timers:    make(map[string]*time.Timer),
+		cancels:   make(map[string]context.CancelFunc),
+	}
+	s.resume()
+	return s, nil
+}
+
+func (s *Scheduler) resume() {
+	now := time.Now()
+	for _, job := range s.store.list() {
+		if job.finished() {
+			continue
+		}
+		if !job.End().After(now) {
+			s.finish(job.ID, StatusFailed, errors.New("proxy was not running during the scheduled window"))
+			continue
+		}
+		log.Infof("Resuming recording job %s (%s)", job.ID, job.Status)
+		s.arm(job)
+	}
+}
+
+// Schedule validates and persists a new job, then arms it for its start time.
+func (s *Scheduler) Schedule(req JobRequest) (Job, error) {
+	if err := req.validate(); err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	start := req.Start
+	if start.IsZero() || start.Before(now) {
+		start = now
+	}
+
+	job := &Job{
+		ID:        newJobID(),
+		Url:       strings.TrimSpace(req.Url),
+		Headers:   req.Headers,
+		Start:     start,
+		Duration:  req.Duration,
+		Variant:   req.Variant,
+		Status:    StatusScheduled,
+		CreatedAt: now,
+	}
+	job.OutputDir = filepath.Join(s.outputDir, job.ID)
+
+	if err := s.store.put(job); err != nil {
+		return Job{}, err
+	}
+	log.Infof("Scheduled recording job %s for %s at %s", job.ID, job.Url, job.Start.Format(time.RFC3339))
+	s.arm(*job)
+	return *job, nil
+}
+
+// Jobs lists every known job ordered by start time.
+func (s *Scheduler) Jobs() []Job {
+	return s.store.list()
+}
+
+// Job returns a single job by identifier.
+func (s *Scheduler) Job(id string) (Job, bool) {
+	return s.store.get(id)
+}
+
+// Cancel stops a scheduled or running job, keeping whatever was already captured.
+func (s *Scheduler) Cancel(id string) (Job, error) {
+	job, ok := s.store.get(id)
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	if job.finished() {
+		return job, nil
+	}
+	s.disarm(id)
+	return s.finish(id, StatusCancelled, nil)
+}
+
+// Delete cancels a job and forgets it. Captured files are left on disk.
+func (s *Scheduler) Delete(id string) error {
+	s.disarm(id)
+	return s.store.remove(id)
+}
+
+func (s *Scheduler) arm(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, running := s.cancels[job.ID]; running {
+		return
+	}
+	if timer, ok := s.timers[job.ID]; ok {
+		timer.Stop()
+	}
+	s.timers[job.ID] = time.AfterFunc(time.Until(job.Start), func() {
+		s.start(job.ID)
+	})
+}
+
+func (s *Scheduler) disarm(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+		delete(s.cancels, id)
+	}
+}
+
+func (s *Scheduler) start(id string) {
+	finished := false
+	job, err := s.store.update(id, func(job *Job) {
+		// cancelled between the timer firing and getting here
+		if finished = job.finished(); finished {
+			return
+		}
+		job.Status = StatusRecording
+		if job.StartedAt.IsZero() {
+			job.StartedAt = time.Now()
+		}
+	})
+	if err != nil {
+		log.Warnf("Recording job %s could not start: %v", id, err)
+		return
+	}
+	if finished {
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), job.End())
+	s.mu.Lock()
+	if _, armed := s.timers[id]; !armed {
+		// disarmed by Cancel or Delete while the job was being marked as recording
+		s.mu.Unlock()
+		cancel()
+		return
+	}
+	delete(s.timers, id)
+	s.cancels[id] = cancel
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		log.Infof("Recording job %s started", id)
+		captureErr := s.capture(ctx, job)
+
+		s.mu.Lock()
+		_, stillActive := s.cancels[id]
+		delete(s.cancels, id)
+		s.mu.Unlock()
+		if !stillActive {
+			return
+		}
+
+		if captureErr != nil {
+			log.Warnf("Recording job %s failed: %v", id, captureErr)
+			s.finish(id, StatusFailed, captureErr)
+			return
+		}
+		log.Infof("Recording job %s completed", id)
+		s.finish(id, StatusCompleted, nil)
+	}()
+}
+
+func (s *Scheduler) finish(id string, status Status, cause error) (Job, error) {
+	job, err := s.store.update(id, func(job *Job) {
+		job.Status = status
+		job.FinishedAt = time.Now()
+		if cause != nil {
+			job.Error = cause.Error()
+		}
+	})
+	if err != nil {
+		log.Warnf("Failed to persist recording job %s: %v", id, err)
+	}
+	return job, err
+}
+
+// recordProgress persists the segments captured in one playlist refresh, so the job store is
+// written once per refresh rather than once per segment.
+func (s *Scheduler) recordProgress(id string, segments int, bytes int64, lastSegment string) {
+	if _, err := s.store.update(id, func(job *Job) {
+		job.Segments += segments
+		job.Bytes += bytes
+		job.LastSegment = lastSegment
+	}); err != nil {
+		log.Warnf("Failed to persist recording progress for %s: %v", id, err)
+	}
+}
+
+func newJobID() string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Schedule adds a job to the process-wide scheduler.
+func Schedule(req JobRequest) (Job, error) {
+	if scheduler == nil {
+		return Job{}, ErrSchedulerDisabled
+	}
+	return scheduler.Schedule(req)
+}
+
+// Jobs lists the jobs of the process-wide scheduler.
+func Jobs() ([]Job, error) {
+	if scheduler == nil {
+		return nil, ErrSchedulerDisabled
+	}
+	return scheduler.Jobs(), nil
+}
+
+// GetJob looks up a job in the process-wide scheduler.
+func GetJob(id string) (Job, error) {
+	if scheduler == nil {
+		return Job{}, ErrSchedulerDisabled
+	}
+	job, ok := scheduler.Job(id)
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// CancelJob stops a job in the process-wide scheduler.
+func CancelJob(id string) (Job, error) {
+	if scheduler == nil {
+		return Job{}, ErrSchedulerDisabled
+	}
+	return scheduler.Cancel(id)
+}
+
+// DeleteJob removes a job from the process-wide scheduler.
+func DeleteJob(id string) error {
+	if scheduler == nil {
+		return ErrSchedulerDisabled
+	}
+	return scheduler.Delete(id)
+}
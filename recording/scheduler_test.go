@@ -0,0 +1,38 @@
+package recording
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelledJobsDoNotStartLate(t *testing.T) {
+	s, err := NewScheduler(t.TempDir())
+	require.NoError(t, err)
+	request := JobRequest{
+		Url:      "http://origin.example/live.m3u8",
+		Start:    time.Now().Add(time.Hour),
+		Duration: Duration(time.Hour),
+	}
+
+	// the timer fired, but Cancel finished the job before start got to it
+	job, err := s.Schedule(request)
+	require.NoError(t, err)
+	_, err = s.Cancel(job.ID)
+	require.NoError(t, err)
+	s.start(job.ID)
+	job, _ = s.Job(job.ID)
+	assert.Equal(t, StatusCancelled, job.Status)
+
+	// Cancel disarmed the job while start was marking it as recording
+	job, err = s.Schedule(request)
+	require.NoError(t, err)
+	s.disarm(job.ID)
+	s.start(job.ID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Empty(t, s.cancels)
+}
@@ -0,0 +1,123 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsigned         = errors.New("proxy URL is not signed")
+	ErrExpired          = errors.New("proxy URL has expired")
+	ErrInvalidSignature = errors.New("proxy URL signature is invalid")
+)
+
+// Query parameters carrying the expiry, in unix seconds, and the signature.
+const (
+	ExpiresParam   = "exp"
+	SignatureParam = "sig"
+)
+
+// signedParams are the other query parameters a proxy URL carries, the playlist ID and the
+// segment key and IV. They are covered by the signature, so a signed URL cannot be pointed
+// at another playlist or key.
+var signedParams = []string{"iv", "key", "pId"}
+
+var (
+	mu     sync.RWMutex
+	secret []byte
+	ttl    time.Duration
+)
+
+// Configure enables signing with the given secret; rewritten URLs stay valid for urlTTL. An
+// empty secret disables signing.
+func Configure(key string, urlTTL time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	secret = []byte(key)
+	ttl = urlTTL
+}
+
+// Enabled reports whether proxy URLs must be signed.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(secret) > 0
+}
+
+// TTL is how long rewritten URLs stay valid.
+func TTL() time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	return ttl
+}
+
+// Expires is when a URL signed at now for the configured TTL expires. now is rounded down to
+// a quarter of the TTL first, so a playlist refreshed within that window hands out the same
+// URLs, each valid for at least three quarters of the TTL.
+func Expires(now time.Time) time.Time {
+	ttl := TTL()
+	if step := ttl / 4; step > 0 {
+		now = now.Truncate(step)
+	}
+	return now.Add(ttl)
+}
+
+func sign(token string, expires int64, query url.Values) string {
+	mu.RLock()
+	mac := hmac.New(sha256.New, secret)
+	mu.RUnlock()
+	mac.Write([]byte(token))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(canonicalQuery(query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalQuery encodes the signed parameters of query in a fixed order.
+func canonicalQuery(query url.Values) string {
+	canonical := url.Values{}
+	for _, name := range signedParams {
+		if values, ok := query[name]; ok {
+			canonical[name] = values
+		}
+	}
+	return canonical.Encode()
+}
+
+// Query returns the encoded query string carrying params and the signature of token and
+// params until expires. params may be nil.
+func Query(token string, expires time.Time, params url.Values) string {
+	values := url.Values{}
+	for name, value := range params {
+		values[name] = value
+	}
+	values.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	values.Set(SignatureParam, sign(token, expires.Unix(), params))
+	return values.Encode()
+}
+
+// Verify checks the expiry and the signature a request carried for token and its query.
+func Verify(token string, query url.Values) error {
+	expires, signature := query.Get(ExpiresParam), query.Get(SignatureParam)
+	if expires == "" || signature == "" {
+		return ErrUnsigned
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(token, unix, query))) {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > unix {
+		return ErrExpired
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package signing
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	Configure("secret", time.Hour)
+	defer Configure("", 0)
+
+	query, err := url.ParseQuery(Query("token", time.Now().Add(time.Minute), nil))
+	require.NoError(t, err)
+	exp := query.Get(ExpiresParam)
+
+	assert.NoError(t, Verify("token", query))
+	assert.ErrorIs(t, Verify("other", query), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("token", url.Values{ExpiresParam: {"1" + exp}, SignatureParam: query[SignatureParam]}), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("token", url.Values{}), ErrUnsigned)
+
+	query, err = url.ParseQuery(Query("token", time.Now().Add(-time.Minute), nil))
+	require.NoError(t, err)
+	assert.ErrorIs(t, Verify("token", query), ErrExpired)
+}
+
+func TestVerifyCoversThePlaylistAndKeyParameters(t *testing.T) {
+	Configure("secret", time.Hour)
+	defer Configure("", 0)
+
+	query, err := url.ParseQuery(Query("token", time.Now().Add(time.Minute), url.Values{"pId": {"playlist"}, "key": {"k"}, "iv": {"7"}}))
+	require.NoError(t, err)
+	assert.NoError(t, Verify("token", query))
+
+	for _, name := range []string{"pId", "key", "iv"} {
+		tampered := url.Values{}
+		for k, v := range query {
+			tampered[k] = v
+		}
+		tampered.Set(name, "other")
+		assert.ErrorIs(t, Verify("token", tampered), ErrInvalidSignature, name)
+		tampered.Del(name)
+		assert.ErrorIs(t, Verify("token", tampered), ErrInvalidSignature, name)
+	}
+
+	// parameters outside the signed set are ignored
+	query.Set("t", "123")
+	assert.NoError(t, Verify("token", query))
+}
+
+func TestExpiresIsStableWithinAWindow(t *testing.T) {
+	Configure("secret", time.Hour)
+	defer Configure("", 0)
+
+	start := time.Now().Truncate(15 * time.Minute)
+	assert.Equal(t, Expires(start), Expires(start.Add(14*time.Minute)))
+	assert.Equal(t, start.Add(time.Hour), Expires(start.Add(time.Minute)))
+	assert.NotEqual(t, Expires(start), Expires(start.Add(15*time.Minute)))
+}
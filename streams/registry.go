@@ -0,0 +1,413 @@
+package streams
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/upstream"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrStreamNotFound   = errors.New("stream not found")
+	ErrUnknownChild     = errors.New("unknown stream URL")
+	ErrInvalidStream    = errors.New("invalid stream definition")
+	ErrRegistryDisabled = errors.New("stream registry is not running")
+)
+
+// EntryName is the name under /s/<id>/ that serves the registered playlist itself.
+const EntryName = "index.m3u8"
+
+// idBlock is how many child IDs are reserved on disk at a time. After a restart numbering
+// resumes past the reservation, so a URL handed out before the last flush never comes back
+// pointing at a different origin URL.
+const idBlock = 256
+
+const idAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Definition is what a client registers: the playlist to proxy and what to send upstream.
+type Definition struct {
+	Url       string            `json:"url"`
+	Referer   string            `json:"referer,omitempty"`
+	Origin    string            `json:"origin,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Cookies   map[string]string `json:"cookies,omitempty"`
+	Proxy     string            `json:"proxy,omitempty"`
+}
+
+// Stream is a registered definition under its short ID.
+type Stream struct {
+	ID string `json:"id"`
+	Definition
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// child is an origin URL one of the stream's playlists points at.
+type child struct {
+	URL  string    `json:"url"`
+	Seen time.Time `json:"seen"`
+}
+
+type entry struct {
+	Stream   Stream            `json:"stream"`
+	Children map[string]*child `json:"children,omitempty"`
+	Reserved uint64            `json:"reserved"`
+
+	next  uint64
+	byURL map[string]string
+}
+
+// Registry maps short stream IDs to definitions, and each stream's compact child IDs to the
+// origin URLs its playlists point at. It is mirrored to a JSON file so the URLs players hold
+// keep working across restarts.
+type Registry struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*entry
+	dirty   bool
+	stop    chan struct{}
+}
+
+var registry *Registry
+
+// Init loads the registry from the configured directory and starts flushing it to disk.
+func Init(c *model.Config) error {
+	r, err := NewRegistry(filepath.Join(c.StreamRegistryDir, "streams.json"), c.PlaylistRetention)
+	if err != nil {
+		return err
+	}
+	r.startFlusher(c.JanitorInterval)
+	registry = r
+	return nil
+}
+
+// NewRegistry loads the registry kept at path. Child URLs not seen for retention are
+// forgotten when the registry is flushed.
+func NewRegistry(path string, retention time.Duration) (*Registry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create stream registry directory: %w", err)
+	}
+
+	r := &Registry{path: path, retention: retention, streams: make(map[string]*entry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read stream registry: %w", err)
+	}
+
+	var entries []*entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("decode stream registry: %w", err)
+	}
+	for _, e := range entries {
+		if e == nil || e.Stream.ID == "" {
+			continue
+		}
+		if e.Children == nil {
+			e.Children = make(map[string]*child)
+		}
+		e.byURL = make(map[string]string, len(e.Children))
+		for id, c := range e.Children {
+			e.byURL[c.URL] = id
+		}
+		e.next = e.Reserved
+		r.streams[e.Stream.ID] = e
+	}
+	return r, nil
+}
+
+// Register validates def and stores it under a new short ID.
+func (r *Registry) Register(def Definition) (Stream, error) {
+	def.Url = strings.TrimSpace(def.Url)
+	if def.Url == "" {
+		return Stream{}, fmt.Errorf("%w: url is required", ErrInvalidStream)
+	}
+	if !strings.HasPrefix(def.Url, "http://") && !strings.HasPrefix(def.Url, "https://") {
+		return Stream{}, fmt.Errorf("%w: unsupported url %q", ErrInvalidStream, def.Url)
+	}
+	if err := upstream.CheckProxy(def.Proxy); err != nil {
+		return Stream{}, fmt.Errorf("%w: %v", ErrInvalidStream, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := newStreamID()
+	for r.streams[id] != nil {
+		id = newStreamID()
+	}
+	e := &entry{
+		Stream:   Stream{ID: id, Definition: def, CreatedAt: time.Now().UTC()},
+		Children: make(map[string]*child),
+		byURL:    make(map[string]string),
+	}
+	r.streams[id] = e
+	if err := r.writeLocked(); err != nil {
+		delete(r.streams, id)
+		return Stream{}, err
+	}
+	return e.Stream, nil
+}
+
+func (r *Registry) Get(id string) (Stream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.streams[id]
+	if !ok {
+		return Stream{}, false
+	}
+	return e.Stream, true
+}
+
+func (r *Registry) List() []Stream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Stream, 0, len(r.streams))
+	for _, e := range r.streams {
+		out = append(out, e.Stream)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	return out
+}
+
+func (r *Registry) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.streams[id]; !ok {
+		return ErrStreamNotFound
+	}
+	delete(r.streams, id)
+	return r.writeLocked()
+}
+
+// ChildPath returns the proxy path, relative to the server root, under which the stream
+// serves target. The same target always gets the same path.
+func (r *Registry) ChildPath(streamID, target string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.streams[streamID]
+	if !ok {
+		return "", ErrStreamNotFound
+	}
+
+	id, ok := e.byURL[target]
+	if !ok {
+		if e.next >= e.Reserved {
+			e.Reserved = e.next + idBlock
+			if err := r.writeLocked(); err != nil {
+				e.Reserved = e.next
+				return "", err
+			}
+		}
+		id = strconv.FormatUint(e.next, 10)
+		e.next++
+		e.Children[id] = &child{URL: target}
+		e.byURL[target] = id
+	}
+	e.Children[id].Seen = time.Now()
+	r.dirty = true
+	return "s/" + streamID + "/" + id + childExt(target), nil
+}
+
+// Resolve returns the input for a name under /s/<id>/: EntryName for the registered
+// playlist, or a child path handed out by ChildPath.
+func (r *Registry) Resolve(streamID, name string) (*model.Input, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.streams[streamID]
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+
+	target := e.Stream.Url
+	if name != EntryName {
+		c, ok := e.Children[strings.TrimSuffix(name, path.Ext(name))]
+		if !ok {
+			return nil, ErrUnknownChild
+		}
+		c.Seen = time.Now()
+		r.dirty = true
+		target = c.URL
+	}
+
+	def := e.Stream.Definition
+	return &model.Input{
+		Url:       target,
+		Referer:   def.Referer,
+		Origin:    def.Origin,
+		UserAgent: def.UserAgent,
+		Headers:   def.Headers,
+		Cookies:   def.Cookies,
+		Proxy:     def.Proxy,
+		Encoded:   "s/" + streamID + "/" + name,
+		StreamID:  streamID,
+	}, nil
+}
+
+// Flush forgets child URLs not seen within the retention and writes pending changes.
+func (r *Registry) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retention > 0 {
+		cutoff := time.Now().Add(-r.retention)
+		for _, e := range r.streams {
+			for id, c := range e.Children {
+				if c.Seen.Before(cutoff) {
+					delete(e.Children, id)
+					delete(e.byURL, c.URL)
+					r.dirty = true
+				}
+			}
+		}
+	}
+	if !r.dirty {
+		return nil
+	}
+	return r.writeLocked()
+}
+
+func (r *Registry) startFlusher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	r.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Flush(); err != nil {
+					log.Warnf("flush stream registry: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop)
+}
+
+func (r *Registry) writeLocked() error {
+	entries := make([]*entry, 0, len(r.streams))
+	for _, e := range r.streams {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Stream.CreatedAt.Before(entries[j].Stream.CreatedAt)
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("encode stream registry: %w", err)
+	}
+
+	// streams carry origin headers and cookies, so only the proxy's user may read them
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write stream registry temp file: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("finalize stream registry: %w", err)
+	}
+	r.dirty = false
+	return nil
+}
+
+// childExt keeps a short extension from target, so players and content type detection still
+// see what kind of file a child path is.
+func childExt(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	ext := path.Ext(parsed.Path)
+	if len(ext) < 2 || len(ext) > 6 {
+		return ""
+	}
+	for _, ch := range ext[1:] {
+		if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+func newStreamID() string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	for i, b := range buf {
+		buf[i] = idAlphabet[int(b)%len(idAlphabet)]
+	}
+	return string(buf)
+}
+
+// EntryPath is the proxy path, relative to the server root, of a registered playlist.
+func EntryPath(id string) string {
+	return "s/" + id + "/" + EntryName
+}
+
+// Register adds a stream to the process-wide registry.
+func Register(def Definition) (Stream, error) {
+	if registry == nil {
+		return Stream{}, ErrRegistryDisabled
+	}
+	return registry.Register(def)
+}
+
+func Get(id string) (Stream, error) {
+	if registry == nil {
+		return Stream{}, ErrRegistryDisabled
+	}
+	stream, ok := registry.Get(id)
+	if !ok {
+		return Stream{}, ErrStreamNotFound
+	}
+	return stream, nil
+}
+
+func List() ([]Stream, error) {
+	if registry == nil {
+		return nil, ErrRegistryDisabled
+	}
+	return registry.List(), nil
+}
+
+func Delete(id string) error {
+	if registry == nil {
+		return ErrRegistryDisabled
+	}
+	return registry.Delete(id)
+}
+
+func ChildPath(streamID, target string) (string, error) {
+	if registry == nil {
+		return "", ErrRegistryDisabled
+	}
+	return registry.ChildPath(streamID, target)
+}
+
+func Resolve(streamID, name string) (*model.Input, error) {
+	if registry == nil {
+		return nil, ErrRegistryDisabled
+	}
+	return registry.Resolve(streamID, name)
+}
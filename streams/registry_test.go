@@ -0,0 +1,78 @@
+package streams
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryResolvesChildPathsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "streams.json")
+	registry, err := NewRegistry(path, time.Hour)
+	require.NoError(t, err)
+
+	stream, err := registry.Register(Definition{Url: "https://origin/live/index.m3u8", Referer: "https://origin"})
+	require.NoError(t, err)
+	assert.Len(t, stream.ID, 6)
+
+	child, err := registry.ChildPath(stream.ID, "https://origin/live/720p.m3u8?token=abc")
+	require.NoError(t, err)
+	assert.Equal(t, "s/"+stream.ID+"/0.m3u8", child)
+	again, err := registry.ChildPath(stream.ID, "https://origin/live/720p.m3u8?token=abc")
+	require.NoError(t, err)
+	assert.Equal(t, child, again)
+	segment, err := registry.ChildPath(stream.ID, "https://origin/live/seg-1.ts")
+	require.NoError(t, err)
+	assert.Equal(t, "s/"+stream.ID+"/1.ts", segment)
+	require.NoError(t, registry.Flush())
+
+	// an ID handed out after the last flush must not be reused for another URL
+	_, err = registry.ChildPath(stream.ID, "https://origin/live/seg-2.ts")
+	require.NoError(t, err)
+
+	reloaded, err := NewRegistry(path, time.Hour)
+	require.NoError(t, err)
+	input, err := reloaded.Resolve(stream.ID, "0.m3u8")
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin/live/720p.m3u8?token=abc", input.Url)
+	assert.Equal(t, "https://origin", input.Referer)
+	assert.Equal(t, stream.ID, input.StreamID)
+
+	_, err = reloaded.Resolve(stream.ID, "2.ts")
+	assert.ErrorIs(t, err, ErrUnknownChild)
+	next, err := reloaded.ChildPath(stream.ID, "https://origin/live/seg-3.ts")
+	require.NoError(t, err)
+	assert.Equal(t, "s/"+stream.ID+"/256.ts", next)
+
+	entry, err := reloaded.Resolve(stream.ID, EntryName)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin/live/index.m3u8", entry.Url)
+}
+
+func TestRegistryForgetsUnseenChildren(t *testing.T) {
+	registry, err := NewRegistry(filepath.Join(t.TempDir(), "streams.json"), time.Minute)
+	require.NoError(t, err)
+	stream, err := registry.Register(Definition{Url: "https://origin/index.m3u8"})
+	require.NoError(t, err)
+
+	_, err = registry.ChildPath(stream.ID, "https://origin/old.ts")
+	require.NoError(t, err)
+	registry.streams[stream.ID].Children["0"].Seen = time.Now().Add(-2 * time.Minute)
+	_, err = registry.ChildPath(stream.ID, "https://origin/new.ts")
+	require.NoError(t, err)
+	require.NoError(t, registry.Flush())
+
+	_, err = registry.Resolve(stream.ID, "0.ts")
+	assert.ErrorIs(t, err, ErrUnknownChild)
+	_, err = registry.Resolve(stream.ID, "1.ts")
+	assert.NoError(t, err)
+
+	_, err = registry.Register(Definition{Url: "ftp://origin/index.m3u8"})
+	assert.ErrorIs(t, err, ErrInvalidStream)
+	require.NoError(t, registry.Delete(stream.ID))
+	_, err = registry.Resolve(stream.ID, EntryName)
+	assert.ErrorIs(t, err, ErrStreamNotFound)
+}
@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bariiss/hls-proxy/model"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/bariiss/hls-proxy"
+
+// tracer resolves the global provider on every call, so spans started before Configure
+// runs, or while tracing is off, are no-ops.
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(instrumentationName)
+}
+
+// propagate reports whether outgoing requests carry trace context to origins.
+var propagate atomic.Bool
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+}
+
+/*
+Configure exports spans over OTLP/HTTP to the configured endpoint, e.g.
+"http://collector:4318"; the /v1/traces path is added when the URL has none. With no
+endpoint, tracing stays disabled. Trace context is only sent to origins when
+TracingPropagate is set. The returned function flushes pending spans.
+*/
+func Configure(c *model.Config) (func(context.Context) error, error) {
+	propagate.Store(c.TracingPropagate)
+	if c.TracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(c.TracingEndpoint, "/")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return Use(exporter, c.TracingSampleRatio)
+}
+
+// Use installs a tracer provider that batches spans into exporter, sampling the given
+// fraction of traces that do not arrive with a sampling decision from the caller.
+func Use(exporter sdktrace.SpanExporter, sampleRatio float64) (func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "hls-proxy"),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn("Tracing: ", err)
+	}))
+	return provider.Shutdown, nil
+}
+
+// Start opens a span as a child of whatever span ctx carries.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer opens the span for an incoming request, continuing the caller's trace when
+// the request carries W3C trace context.
+func StartServer(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+	))
+}
+
+// StartClient opens a span for an outgoing request. With propagation on, it also writes the
+// trace context into the request headers, so the origin can join the trace.
+func StartClient(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("http.request.method", r.Method),
+		FullURL(r.URL.String()),
+	)
+	ctx, span := tracer().Start(r.Context(), name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	r = r.WithContext(ctx)
+	if propagate.Load() {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	return r, span
+}
+
+// FullURL is the url.full attribute for an origin URL. Query strings and user info often
+// carry origin tokens, so they are left out of exported spans.
+func FullURL(raw string) attribute.KeyValue {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		raw, _, _ = strings.Cut(raw, "?")
+		return attribute.String("url.full", raw)
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.ForceQuery = false
+	parsed.Fragment = ""
+	return attribute.String("url.full", parsed.String())
+}
+
+// Fail marks a span as failed. It is a no-op for a nil error.
+func Fail(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,122 @@
+package tracing_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/model"
+	"github.com/bariiss/hls-proxy/tracing"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an in-process OTLP/HTTP receiver that remembers the names and URLs of
+// exported spans.
+type collector struct {
+	mu    sync.Mutex
+	spans []string
+	urls  []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var request coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans = append(c.spans, span.Name)
+				for _, attr := range span.Attributes {
+					if attr.Key == "url.full" {
+						c.urls = append(c.urls, attr.Value.GetStringValue())
+					}
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(response)
+}
+
+func TestUpstreamAttemptsAreTracedAndPropagated(t *testing.T) {
+	received := &collector{}
+	collectorServer := httptest.NewServer(received)
+	defer collectorServer.Close()
+
+	var traceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte("segment"))
+	}))
+	defer origin.Close()
+	// the origin listens on loopback, which the default upstream policy refuses
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	t.Cleanup(func() { upstream.Use(&upstream.Policy{}) })
+
+	shutdown, err := tracing.Configure(&model.Config{TracingEndpoint: collectorServer.URL, TracingSampleRatio: 1, TracingPropagate: true})
+	require.NoError(t, err)
+
+	ctx, span := tracing.Start(context.Background(), "prefetch clip")
+	request, err := http.NewRequestWithContext(ctx, "GET", origin.URL+"/a.ts", nil)
+	require.NoError(t, err)
+	data, err := http_retry.ExecuteRetryClipRequest(request, 1)
+	require.NoError(t, err)
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	assert.Equal(t, []byte("segment"), data)
+	// version 00, then the trace ID of the job the attempt belongs to
+	assert.Regexp(t, "^00-"+span.SpanContext().TraceID().String()+"-[0-9a-f]{16}-01$", traceparent)
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	assert.ElementsMatch(t, []string{"http_retry attempt", "prefetch clip"}, received.spans)
+}
+
+func TestOriginsGetNoTraceContextOrTokensByDefault(t *testing.T) {
+	received := &collector{}
+	collectorServer := httptest.NewServer(received)
+	defer collectorServer.Close()
+
+	traceparent := "unset"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte("segment"))
+	}))
+	defer origin.Close()
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	t.Cleanup(func() { upstream.Use(&upstream.Policy{}) })
+
+	shutdown, err := tracing.Configure(&model.Config{TracingEndpoint: collectorServer.URL, TracingSampleRatio: 1})
+	require.NoError(t, err)
+
+	ctx, span := tracing.Start(context.Background(), "prefetch clip")
+	request, err := http.NewRequestWithContext(ctx, "GET", origin.URL+"/a.ts?token=secret", nil)
+	require.NoError(t, err)
+	_, err = http_retry.ExecuteRetryClipRequest(request, 1)
+	require.NoError(t, err)
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	assert.Empty(t, traceparent)
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	assert.Equal(t, []string{origin.URL + "/a.ts"}, received.urls)
+}
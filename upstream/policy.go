@@ -0,0 +1,258 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/bariiss/hls-proxy/model"
+)
+
+// ErrBlocked matches every error returned for an upstream the policy refuses.
+var ErrBlocked = errors.New("upstream blocked by policy")
+
+// BlockedError says which upstream was refused and why.
+type BlockedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("upstream %s blocked: %s", e.Host, e.Reason)
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// reservedNets are not private in the netip sense but are no more reachable from the internet.
+var reservedNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+/*
+Policy decides which origins the proxy may fetch from. Host globs such as "*.example.com"
+gate host names before a request is sent; CIDRs and addresses gate the addresses a
+connection is actually made to, so a name that resolves somewhere else later cannot get
+around them.
+
+  - anything on the deny list is refused
+  - with host globs on the allow list, other names and IP literals outside the allowed
+    CIDRs are refused
+  - with only CIDRs on the allow list, connections outside them are refused
+  - private, loopback, link-local and unspecified addresses are refused unless allowed by
+    CIDR or allowPrivate is set
+*/
+type Policy struct {
+	allowHosts   []string
+	allowNets    []netip.Prefix
+	denyHosts    []string
+	denyNets     []netip.Prefix
+	allowPrivate bool
+}
+
+var current atomic.Pointer[Policy]
+
+func init() {
+	current.Store(&Policy{})
+}
+
+// Configure applies the upstream policy, TLS settings and proxy rules.
+func Configure(c *model.Config) error {
+	policy, err := NewPolicy(splitList(c.UpstreamAllow), splitList(c.UpstreamDeny), c.UpstreamAllowPrivate)
+	if err != nil {
+		return err
+	}
+	rules, err := NewTLSRules(splitList(c.UpstreamTLSInsecure), splitList(c.UpstreamCABundle), splitList(c.UpstreamClientCerts))
+	if err != nil {
+		return err
+	}
+	proxies, err := NewProxyRules(c.UpstreamProxy, splitList(c.UpstreamProxies), splitList(c.UpstreamProxyRules))
+	if err != nil {
+		return err
+	}
+	Use(policy)
+	UseTLS(rules)
+	UseProxies(proxies)
+	return nil
+}
+
+// Use makes policy the one every upstream request is checked against.
+func Use(policy *Policy) {
+	current.Store(policy)
+}
+
+// NewPolicy builds a policy from allow and deny entries, each a host glob, an IP address or
+// a CIDR.
+func NewPolicy(allow, deny []string, allowPrivate bool) (*Policy, error) {
+	p := &Policy{allowPrivate: allowPrivate}
+	var err error
+	if p.allowHosts, p.allowNets, err = parseRules(allow); err != nil {
+		return nil, fmt.Errorf("upstream allow list: %w", err)
+	}
+	if p.denyHosts, p.denyNets, err = parseRules(deny); err != nil {
+		return nil, fmt.Errorf("upstream deny list: %w", err)
+	}
+	return p, nil
+}
+
+// CheckHost checks a host name or IP literal before a request is sent.
+func (p *Policy) CheckHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if len(p.allowHosts) > 0 && !containsAddr(p.allowNets, addr) {
+			return &BlockedError{Host: host, Reason: "address not on the allow list"}
+		}
+		return p.CheckAddr(host, addr)
+	}
+
+	if matchesHost(p.denyHosts, host) {
+		return &BlockedError{Host: host, Reason: "host is on the deny list"}
+	}
+	if len(p.allowHosts) > 0 && !matchesHost(p.allowHosts, host) {
+		return &BlockedError{Host: host, Reason: "host not on the allow list"}
+	}
+	return nil
+}
+
+// CheckAddr checks an address a connection for host is about to be made to.
+func (p *Policy) CheckAddr(host string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	if containsAddr(p.denyNets, addr) {
+		return &BlockedError{Host: host, Reason: fmt.Sprintf("address %s is on the deny list", addr)}
+	}
+	if containsAddr(p.allowNets, addr) {
+		return nil
+	}
+	if len(p.allowNets) > 0 && len(p.allowHosts) == 0 {
+		return &BlockedError{Host: host, Reason: fmt.Sprintf("address %s not on the allow list", addr)}
+	}
+	if !p.allowPrivate && isPrivate(addr) {
+		return &BlockedError{Host: host, Reason: fmt.Sprintf("address %s is private", addr)}
+	}
+	return nil
+}
+
+// CheckURL checks the host of rawURL against the current policy.
+func CheckURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return current.Load().CheckHost(parsed.Hostname())
+}
+
+// CheckHost checks host against the current policy.
+func CheckHost(host string) error {
+	return current.Load().CheckHost(host)
+}
+
+// CheckLookup resolves host and checks its addresses against the current policy. It stands in
+// for the dial-time check on requests sent through a proxy, where the proxy makes the
+// connection. Names that do not resolve here could point anywhere behind the proxy, so they
+// are refused unless a host glob on the allow list names them.
+func CheckLookup(ctx context.Context, host string) error {
+	if _, err := netip.ParseAddr(host); err == nil {
+		// literals were checked by CheckHost
+		return nil
+	}
+	policy := current.Load()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		if matchesHost(policy.allowHosts, strings.TrimSuffix(strings.ToLower(host), ".")) {
+			return nil
+		}
+		return &BlockedError{Host: host, Reason: "host does not resolve and is not on the allow list"}
+	}
+	for _, addr := range addrs {
+		if err := policy.CheckAddr(host, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Control is a net.Dialer Control function checking the resolved address of every connection
+// against the current policy.
+func Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return &BlockedError{Host: host, Reason: "not an IP address"}
+	}
+	return current.Load().CheckAddr(host, addr)
+}
+
+func isPrivate(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return true
+	}
+	return containsAddr(reservedNets, addr)
+}
+
+func parseRules(entries []string) ([]string, []netip.Prefix, error) {
+	var hosts []string
+	var nets []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				addr = addr.Unmap()
+				nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			if _, err := path.Match(entry, ""); err != nil {
+				return nil, nil, fmt.Errorf("invalid host pattern %q", entry)
+			}
+			hosts = append(hosts, strings.TrimSuffix(entry, "."))
+		}
+	}
+	return hosts, nets, nil
+}
+
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(nets []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
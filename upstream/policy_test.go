@@ -0,0 +1,65 @@
+package upstream_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyAllowAndDenyLists(t *testing.T) {
+	policy, err := upstream.NewPolicy([]string{"*.cdn.example", "203.0.113.0/24"}, []string{"bad.cdn.example", "203.0.113.7"}, false)
+	require.NoError(t, err)
+
+	assert.NoError(t, policy.CheckHost("edge1.cdn.example"))
+	assert.ErrorIs(t, policy.CheckHost("bad.cdn.example"), upstream.ErrBlocked)
+	assert.ErrorIs(t, policy.CheckHost("origin.example"), upstream.ErrBlocked)
+	assert.NoError(t, policy.CheckHost("203.0.113.5"))
+	assert.ErrorIs(t, policy.CheckHost("203.0.113.7"), upstream.ErrBlocked)
+	assert.ErrorIs(t, policy.CheckHost("198.51.100.1"), upstream.ErrBlocked)
+
+	// an allowed name resolving to a private address is still refused when dialling
+	assert.ErrorIs(t, policy.CheckAddr("edge1.cdn.example", netip.MustParseAddr("10.0.0.1")), upstream.ErrBlocked)
+	assert.NoError(t, policy.CheckAddr("edge1.cdn.example", netip.MustParseAddr("198.51.100.1")))
+
+	defaults := &upstream.Policy{}
+	for _, host := range []string{"169.254.169.254", "127.0.0.1", "10.1.2.3", "::1", "fd00::1", "0.0.0.0", "::ffff:192.168.0.1"} {
+		assert.ErrorIs(t, defaults.CheckHost(host), upstream.ErrBlocked, host)
+	}
+	assert.NoError(t, defaults.CheckHost("example.com"))
+
+	_, err = upstream.NewPolicy([]string{"10.0.0.0/33"}, nil, false)
+	assert.Error(t, err)
+}
+
+func TestDefaultClientChecksResolvedAddresses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	}))
+	defer origin.Close()
+	t.Cleanup(func() { upstream.Use(&upstream.Policy{}) })
+
+	// "localhost" passes the host check and is only caught once it resolves to loopback
+	upstream.Use(&upstream.Policy{})
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+	request, err := http.NewRequest("GET", "http://localhost:"+originURL.Port()+"/a.ts", nil)
+	require.NoError(t, err)
+	_, err = http_retry.ExecuteRetryClipRequest(request, 3)
+	assert.ErrorIs(t, err, upstream.ErrBlocked)
+
+	policy, err := upstream.NewPolicy([]string{"127.0.0.0/8"}, nil, false)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	request, err = http.NewRequest("GET", origin.URL+"/a.ts", nil)
+	require.NoError(t, err)
+	data, err := http_retry.ExecuteRetryClipRequest(request, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("segment"), data)
+}
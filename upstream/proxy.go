@@ -0,0 +1,196 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrUnknownProxy is returned for a stream naming an egress proxy that is not configured.
+var ErrUnknownProxy = errors.New("unknown upstream proxy")
+
+// Direct is the egress of requests made without a proxy. Proxy rules use it to exempt hosts
+// from the default proxy.
+const Direct = "direct"
+
+// Egress is a proxy upstream requests are sent through: HTTP (CONNECT for https origins),
+// HTTPS or SOCKS5, with credentials in the URL's user info.
+type Egress struct {
+	Name string
+	URL  *url.URL
+}
+
+/*
+ProxyRules decide which egress each upstream request leaves through:
+
+  - a stream naming one of the named proxies always uses it
+  - otherwise the first host glob rule matching the origin's host picks the egress
+  - otherwise the default egress is used, direct when none is set
+*/
+type ProxyRules struct {
+	named    map[string]*Egress
+	rules    []proxyRule
+	fallback *Egress
+}
+
+type proxyRule struct {
+	pattern string
+	egress  *Egress
+}
+
+type proxyKey struct{}
+
+var currentProxies atomic.Pointer[ProxyRules]
+
+func init() {
+	currentProxies.Store(&ProxyRules{})
+}
+
+// NewProxyRules builds proxy rules from the default egress, named proxies given as
+// "name=url" and host rules given as "glob=egress". The default and rule egresses are a
+// proxy URL, the name of a named proxy or Direct.
+func NewProxyRules(fallback string, named, rules []string) (*ProxyRules, error) {
+	r := &ProxyRules{named: make(map[string]*Egress)}
+	for _, entry := range named {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rawURL, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || name == Direct {
+			return nil, fmt.Errorf("invalid upstream proxy %q, expected \"name=url\"", redactEntry(entry))
+		}
+		proxyURL, err := parseProxyURL(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s: %w", name, err)
+		}
+		r.named[name] = &Egress{Name: name, URL: proxyURL}
+	}
+
+	var err error
+	if r.fallback, err = r.egress(fallback); err != nil {
+		return nil, fmt.Errorf("default upstream proxy: %w", err)
+	}
+
+	for _, entry := range rules {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, value, found := strings.Cut(entry, "=")
+		pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("invalid upstream proxy rule %q, expected \"host=proxy\"", redactEntry(entry))
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		egress, err := r.egress(value)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy rule for %s: %w", pattern, err)
+		}
+		r.rules = append(r.rules, proxyRule{pattern: pattern, egress: egress})
+	}
+	return r, nil
+}
+
+// UseProxies makes rules the ones every upstream request is routed by.
+func UseProxies(rules *ProxyRules) {
+	currentProxies.Store(rules)
+}
+
+// CurrentProxies returns the proxy rules in use.
+func CurrentProxies() *ProxyRules {
+	return currentProxies.Load()
+}
+
+// CheckProxy reports whether a stream may ask for the named proxy; empty leaves the choice
+// to the rules.
+func CheckProxy(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := currentProxies.Load().named[name]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownProxy, name)
+	}
+	return nil
+}
+
+// WithProxy returns a context whose upstream requests go through the named proxy. An empty
+// name leaves ctx as it is.
+func WithProxy(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyKey{}, name)
+}
+
+// For returns the egress a request to host made under ctx goes through, nil for direct.
+func (r *ProxyRules) For(ctx context.Context, host string) (*Egress, error) {
+	if name, ok := ctx.Value(proxyKey{}).(string); ok {
+		egress, ok := r.named[name]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownProxy, name)
+		}
+		return egress, nil
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, rule := range r.rules {
+		if ok, _ := path.Match(rule.pattern, host); ok {
+			return rule.egress, nil
+		}
+	}
+	return r.fallback, nil
+}
+
+// egress resolves a proxy URL, the name of a named proxy or Direct.
+func (r *ProxyRules) egress(value string) (*Egress, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == Direct {
+		return nil, nil
+	}
+	if egress, ok := r.named[value]; ok {
+		return egress, nil
+	}
+	if !strings.Contains(value, "://") {
+		return nil, fmt.Errorf("%w %q", ErrUnknownProxy, value)
+	}
+	proxyURL, err := parseProxyURL(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Egress{Name: proxyURL.Redacted(), URL: proxyURL}, nil
+}
+
+func parseProxyURL(value string) (*url.URL, error) {
+	proxyURL, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return nil, errors.New("invalid proxy URL")
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("proxy URL has no host")
+	}
+	return proxyURL, nil
+}
+
+// redactEntry hides the password of a proxy URL in a "key=url" entry quoted in an error.
+func redactEntry(entry string) string {
+	key, value, found := strings.Cut(entry, "=")
+	if !found {
+		return entry
+	}
+	if parsed, err := url.Parse(strings.TrimSpace(value)); err == nil {
+		return key + "=" + parsed.Redacted()
+	}
+	return key + "=" + value
+}
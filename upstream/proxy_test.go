@@ -0,0 +1,92 @@
+package upstream_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamRequestsGoThroughTheirEgressProxy(t *testing.T) {
+	// forward proxies answering plain HTTP requests themselves, naming the egress and target
+	egress := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Proxy-Authorization")
+			if auth != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			w.Write([]byte(name + " " + r.URL.String()))
+		}))
+	}
+	geo := egress("geo")
+	defer geo.Close()
+	fallback := egress("fallback")
+	defer fallback.Close()
+	withAuth := func(server *httptest.Server) string {
+		return "http://user:secret@" + server.Listener.Addr().String()
+	}
+
+	rules, err := upstream.NewProxyRules(withAuth(fallback),
+		[]string{"geo=" + withAuth(geo)},
+		[]string{"*.geo.example=geo", "direct.example=direct"})
+	require.NoError(t, err)
+	upstream.UseProxies(rules)
+	// the origins only resolve behind the proxies, so the allow list has to name them
+	policy, err := upstream.NewPolicy([]string{"*.example"}, nil, false)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	t.Cleanup(func() {
+		upstream.UseProxies(&upstream.ProxyRules{})
+		upstream.Use(&upstream.Policy{})
+	})
+
+	fetch := func(ctx context.Context, target string) (string, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		require.NoError(t, err)
+		body, err := http_retry.ExecuteRetryClipRequest(request, 1)
+		return string(body), err
+	}
+
+	body, err := fetch(context.Background(), "http://cdn.geo.example/a.ts")
+	require.NoError(t, err)
+	assert.Equal(t, "geo http://cdn.geo.example/a.ts", body)
+
+	body, err = fetch(context.Background(), "http://origin.example/a.ts")
+	require.NoError(t, err)
+	assert.Equal(t, "fallback http://origin.example/a.ts", body)
+
+	// a stream naming a proxy overrides the host rules
+	body, err = fetch(upstream.WithProxy(context.Background(), "geo"), "http://origin.example/b.ts")
+	require.NoError(t, err)
+	assert.Equal(t, "geo http://origin.example/b.ts", body)
+
+	_, err = fetch(upstream.WithProxy(context.Background(), "elsewhere"), "http://origin.example/b.ts")
+	assert.ErrorIs(t, err, upstream.ErrUnknownProxy)
+	assert.ErrorIs(t, upstream.CheckProxy("elsewhere"), upstream.ErrUnknownProxy)
+	assert.NoError(t, upstream.CheckProxy("geo"))
+
+	egressOf, err := rules.For(context.Background(), "direct.example")
+	require.NoError(t, err)
+	assert.Nil(t, egressOf)
+
+	// the policy still applies to origins behind a proxy
+	body, err = fetch(context.Background(), "http://127.0.0.1/a.ts")
+	assert.ErrorIs(t, err, upstream.ErrBlocked, body)
+
+	// without an allow list, a name that does not resolve here is not sent to the proxy
+	upstream.Use(&upstream.Policy{})
+	body, err = fetch(context.Background(), "http://origin.example/a.ts")
+	assert.ErrorIs(t, err, upstream.ErrBlocked, body)
+
+	_, err = upstream.NewProxyRules("", []string{"geo=ftp://proxy.example"}, nil)
+	assert.Error(t, err)
+	_, err = upstream.NewProxyRules("", nil, []string{"*.example=missing"})
+	assert.ErrorIs(t, err, upstream.ErrUnknownProxy)
+}
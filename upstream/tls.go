@@ -0,0 +1,127 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+TLSRules decides how connections to each origin are secured. Certificates are verified
+against the system roots plus any configured CA bundles, except for hosts matching an
+insecure glob. Hosts matching a client certificate's glob present it to origins that ask
+for one.
+*/
+type TLSRules struct {
+	roots       *x509.CertPool
+	insecure    []string
+	clientCerts []clientCert
+}
+
+type clientCert struct {
+	pattern string
+	cert    tls.Certificate
+}
+
+var currentTLS atomic.Pointer[TLSRules]
+
+func init() {
+	currentTLS.Store(&TLSRules{})
+}
+
+// NewTLSRules builds TLS rules from insecure host globs, CA bundle files and client
+// certificates given as "glob=cert.pem:key.pem", or "glob=both.pem" when the key is in the
+// certificate file.
+func NewTLSRules(insecure, caFiles, clientCerts []string) (*TLSRules, error) {
+	r := &TLSRules{}
+	for _, pattern := range insecure {
+		pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		r.insecure = append(r.insecure, pattern)
+	}
+
+	for _, file := range caFiles {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		if r.roots == nil {
+			roots, err := x509.SystemCertPool()
+			if err != nil {
+				roots = x509.NewCertPool()
+			}
+			r.roots = roots
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		if !r.roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+		}
+	}
+
+	for _, entry := range clientCerts {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, files, found := strings.Cut(entry, "=")
+		pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("invalid client certificate %q, expected \"host=cert.pem:key.pem\"", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		certFile, keyFile, found := strings.Cut(files, ":")
+		if !found {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(strings.TrimSpace(certFile), strings.TrimSpace(keyFile))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate for %s: %w", pattern, err)
+		}
+		r.clientCerts = append(r.clientCerts, clientCert{pattern: pattern, cert: cert})
+	}
+	return r, nil
+}
+
+// UseTLS makes rules the ones every upstream connection is set up with.
+func UseTLS(rules *TLSRules) {
+	currentTLS.Store(rules)
+}
+
+// CurrentTLS returns the TLS rules in use.
+func CurrentTLS() *TLSRules {
+	return currentTLS.Load()
+}
+
+// ForHost returns the TLS settings for host and a key naming them. Hosts with the same key
+// get the same settings, so they can share a connection pool.
+func (r *TLSRules) ForHost(host string) (string, *tls.Config) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	insecure := matchesHost(r.insecure, host)
+	key := "verify"
+	if insecure {
+		key = "insecure"
+	}
+	config := &tls.Config{RootCAs: r.roots, InsecureSkipVerify: insecure}
+	for _, c := range r.clientCerts {
+		if ok, _ := path.Match(c.pattern, host); ok {
+			config.Certificates = []tls.Certificate{c.cert}
+			key += " cert " + c.pattern
+			break
+		}
+	}
+	return key, config
+}
@@ -0,0 +1,101 @@
+package upstream_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bariiss/hls-proxy/http_retry"
+	"github.com/bariiss/hls-proxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLSVerificationAndClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey := writeSelfSigned(t, dir, "client")
+	clientPEM, err := os.ReadFile(clientCert)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(clientPEM))
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment"))
+	}))
+	origin.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	origin.StartTLS()
+	defer origin.Close()
+	serverCA := filepath.Join(dir, "origin-ca.pem")
+	require.NoError(t, os.WriteFile(serverCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw}), 0o600))
+
+	policy, err := upstream.NewPolicy(nil, nil, true)
+	require.NoError(t, err)
+	upstream.Use(policy)
+	t.Cleanup(func() {
+		upstream.Use(&upstream.Policy{})
+		upstream.UseTLS(&upstream.TLSRules{})
+	})
+
+	fetch := func(rules *upstream.TLSRules) error {
+		upstream.UseTLS(rules)
+		request, err := http.NewRequest("GET", origin.URL+"/a.ts", nil)
+		require.NoError(t, err)
+		_, err = http_retry.ExecuteRetryClipRequest(request, 1)
+		return err
+	}
+
+	// the origin's certificate is not trusted by default
+	assert.Error(t, fetch(&upstream.TLSRules{}))
+
+	trusted, err := upstream.NewTLSRules(nil, []string{serverCA}, nil)
+	require.NoError(t, err)
+	assert.Error(t, fetch(trusted), "origin requires a client certificate")
+
+	withCert, err := upstream.NewTLSRules(nil, []string{serverCA}, []string{"127.0.0.*=" + clientCert + ":" + clientKey})
+	require.NoError(t, err)
+	assert.NoError(t, fetch(withCert))
+
+	insecure, err := upstream.NewTLSRules([]string{"127.0.0.1"}, nil, []string{"127.0.0.1=" + clientCert + ":" + clientKey})
+	require.NoError(t, err)
+	assert.NoError(t, fetch(insecure))
+
+	_, err = upstream.NewTLSRules(nil, []string{clientKey}, nil)
+	assert.Error(t, err)
+}
+
+func writeSelfSigned(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}